@@ -6,16 +6,16 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
-	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	"io/ioutil"
 
+	"git.bofh.at/mla/phs/pkg/phsclient"
 	"git.bofh.at/mla/phs/pkg/phsserver"
-	"github.com/prometheus/client_golang/prometheus"
 	"git.bofh.at/mla/phs/version"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"net/url"
 	"bytes"
 
 	"github.com/gorilla/mux"
@@ -31,10 +31,6 @@ type Service struct {
 	ServerMetrics phsserver.ServerMetrics
 }
 
-type MonitoredClient struct {
-	http.Client
-}
-
 const endpointURL = "http://10.20.30.123:9411/api/v2/spans"
 
 func newTracer()(*zipkin.Tracer, error) {
@@ -61,122 +57,39 @@ func newTracer()(*zipkin.Tracer, error) {
 	return t, err
 }
 
-/*
-func NewMonitoredClient(c http.Client,
-	counter *prometheus.CounterVec,
-	histo *prometheus.HistogramVec,
-	endpoint string) *MonitoredClient{
-	mc := &MonitoredClient{c}
-	fmt.Printf("@@@mla@@@: Monitored client: mc.Tansport = %+v\n",mc.Transport)
-	if mc.Transport == nil {
-		mc.Transport = http.DefaultTransport
-	}
-	mc.Transport = promhttp.InstrumentRoundTripperCounter(
-		counter.MustCurryWith(prometheus.Labels{
-			"action": "unknown",
-			"endpoint": endpoint}),
-		mc.Transport)
-	mc.Transport = promhttp.InstrumentRoundTripperDuration(
-		histo.MustCurryWith(prometheus.Labels{
-			"action": "unknown",
-			"endpoint": endpoint}),
-		mc.Transport)
-	return mc
-}
-
-
-func bp(c *MonitoredClient, req *http.Request) (*http.Response, error ) {
-	return 	c.Do(req)
-
-}
-*/
-
-type actionIdType int
-const (
-	actionIdKey actionIdType = iota
-)
-
-type Client struct {
-	// HTTP client used to communicate with the DO API.
-	client *http.Client
-	BaseURL *url.URL
-
-	// Prometheus Metrics
-	ReqCounter *prometheus.CounterVec
-	ReqDurationHisto *prometheus.HistogramVec
-
-	// Add whatever is needed here
-	ExternalService *ExternalServiceOp
+// ExternalService is the client of the remote service called by the
+// expensive handler.
+type ExternalService interface {
+	Get(context.Context) (string, error)
 }
 
-func (c *Client) NewRequest(
-	ctx context.Context,
-	method, urlStr string,
-	body interface{}) (*http.Request, error) {
-
-	rel, err := url.Parse(urlStr)
-	if err != nil {
-		return nil, err
-	}
-
-	u := c.BaseURL.ResolveReference(rel)
-	buf := new(bytes.Buffer)
-	s := u.String()
-
-	req, err := http.NewRequest(method, s, buf)
-	return req, nil
-}
-
-// Wrap encapsulates a http.Handler which collects prometheus metrics.
-//func WrapReq(h http.Handler, name string, m *ClientMetrics) http.Handler {
-//
-
-func (c *Client) Do(ctx context.Context, enndpointId string,
-	req *http.Request, v interface{}) (*http.Response, error) {
-	req = req.WithContext(ctx)
-	resp, err := c.client.Do(req)
-	return resp, err
-}
-
-type ExternalService  interface {
-	Get(context.Context) (*http.Response, error)
-}
-
-
 type ExternalServiceOp struct {
-	client *Client
+	client *phsclient.Client
 }
 
-
 var _ ExternalService = &ExternalServiceOp{}
 
-
-func (s ExternalServiceOp) Get(ctx context.Context) (*http.Response, error) {
-	req, err := s.client.NewRequest(ctx,  http.MethodGet, "http://localhost:5080/cheap", nil)
-	resp, err := s.client.Do(ctx, "cheap:get", req, nil)
-	return resp, err
+func (s *ExternalServiceOp) Get(ctx context.Context) (string, error) {
+	req, err := s.client.NewRequest(ctx, http.MethodGet, "cheap", nil)
+	if err != nil {
+		return "", err
+	}
+	var body bytes.Buffer
+	_, err = s.client.Do(ctx, "cheap:get", req, &body)
+	return body.String(), err
 }
 
-
-func NewSvcClient(httpClient *http.Client) *Client {
-
-	if httpClient == nil {
-		httpClient = http.DefaultClient
-	}
-	c := &Client{
-		client: httpClient,
-	}
-	url, err := url.Parse("http://10.20.30.123t:7011/")
+// NewSvcClient returns the ExternalService at baseURL. If httpClient is nil,
+// http.DefaultClient is used.
+func NewSvcClient(httpClient *http.Client, baseURL string) (ExternalService, error) {
+	c, err := phsclient.NewClient(httpClient, baseURL)
 	if err != nil {
-		panic("Invalid base url for client")
+		return nil, err
 	}
-	c.BaseURL = url
-	c.ExternalService = &ExternalServiceOp{client: c}
-	return c
+	return &ExternalServiceOp{client: c}, nil
 }
 
-
-
+var externalService ExternalService
 
 func expensive(w http.ResponseWriter, r *http.Request) {
 
@@ -190,21 +103,15 @@ func expensive(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("fail = %v, Sleeping for %f seconds", fail, d)
 
-	ctx := context.WithValue(context.Background(),
-		actionIdKey, "expensive")
-
-	c := NewSvcClient(nil)
-
-	rsp, err := c.ExternalService.Get(ctx)
+	ctx := phsserver.WithAction(r.Context(), "expensive")
 
+	body, err := externalService.Get(ctx)
 	if err != nil {
 		log.Printf("Request to 'ExternalService.Get' failed. err = %+v\n", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	body, err := ioutil.ReadAll(rsp.Body)
-	bodyString := string(body)
-	log.Printf("Client returns: %s\n", bodyString)
+	log.Printf("Client returns: %s\n", body)
 
 	time.Sleep(time.Duration(d) * time.Second)
 
@@ -233,27 +140,100 @@ func cheap(w http.ResponseWriter, r *http.Request) {
 }
 
 func notFoundHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Metric endpoint with wrong url %q", r.URL)
+	log.Printf("No handler for url %q", r.URL)
 	w.WriteHeader(http.StatusNotFound)
 }
 
+// metricFlags are the command line flags overriding the server metrics
+// configuration.
+type metricFlags struct {
+	durationBuckets phsserver.BucketConfig
+	percentiles     phsserver.PercentileConfig
+	reqSizeBuckets  phsserver.BucketConfig
+	respSizeBuckets phsserver.BucketConfig
+}
+
+// addMetricFlags defines the metric flags in fs.
+func addMetricFlags(fs *flag.FlagSet) *metricFlags {
+	defaults := phsserver.NewDefaultServerMetrics()
+	f := &metricFlags{
+		durationBuckets: defaults.ReqDurationHistConf,
+		percentiles:     defaults.ReqDurationPercentileConf,
+		reqSizeBuckets:  defaults.ReqSizeBuckets,
+		respSizeBuckets: defaults.RespSizeBuckets,
+	}
+	fs.Var(&f.durationBuckets, "duration-buckets",
+		"Request duration buckets in seconds, e.g. \"exp(1ms,2,12)\"")
+	fs.Var(&f.percentiles, "percentiles",
+		"Request duration percentiles with optional error, e.g. \"50;90;99:0.1\"")
+	fs.Var(&f.reqSizeBuckets, "request-size-buckets",
+		"Request size buckets in bytes, empty to disable")
+	fs.Var(&f.respSizeBuckets, "response-size-buckets",
+		"Response size buckets in bytes, empty to disable")
+	return f
+}
 
+// apply sets the metric flags given in fs in m.
+func (f *metricFlags) apply(fs *flag.FlagSet, m *phsserver.ServerMetrics) {
+	fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "duration-buckets":
+			m.ReqDurationHistConf = f.durationBuckets
+		case "percentiles":
+			m.ReqDurationPercentileConf = f.percentiles
+		case "request-size-buckets":
+			m.ReqSizeBuckets = f.reqSizeBuckets
+		case "response-size-buckets":
+			m.RespSizeBuckets = f.respSizeBuckets
+		}
+	})
+}
 
-func runPrometheusEndpoint(mux *mux.Router,  listenAddress string) {
-	l, err := net.Listen("tcp", listenAddress)
+// rules implements the rules subcommand, which writes the Prometheus
+// recording and alerting rules for the metrics configuration. It takes the
+// same metric flags as the server, so the rules match what it registers.
+func rules(args []string) error {
+	fs := flag.NewFlagSet("phs rules", flag.ExitOnError)
+	configFile := fs.String("config", "",
+		"YAML or JSON metrics configuration, overridden by PHS_* environment variables")
+	out := fs.String("o", "", "Output file, standard output if empty")
+	metricFlags := addMetricFlags(fs)
+	fs.Parse(args)
+
+	cfg, err := phsserver.LoadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	serverMetric, err := cfg.ServerMetrics()
+	if err != nil {
+		return err
+	}
+	metricFlags.apply(fs, serverMetric)
+	if err := serverMetric.Validate(); err != nil {
+		return err
+	}
+	clientMetric, err := cfg.ClientMetrics()
 	if err != nil {
-		log.Printf("Cannot listen on %s. err = %v", listenAddress, err)
-		panic("Listen error")
+		return err
 	}
-	defer l.Close()
-	err = http.Serve(l, mux)
+	data, err := phsserver.NewRuleFile(serverMetric, clientMetric).Marshal()
 	if err != nil {
-		log.Printf("metrics endpoint error. err = %v", err)
-		panic("Serving error")
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
 	}
+	return ioutil.WriteFile(*out, data, 0644)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "rules" {
+		if err := rules(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 
 	fmt.Println("Hi, webapp v 1.1 here with client tracer")
@@ -264,6 +244,10 @@ func main() {
 
 	port := flag.Int("port", 5080, "Port to listen on")
 	versionFlag := flag.Bool("version", false, "Version")
+	configFile := flag.String("config", "",
+		"YAML or JSON metrics configuration, overridden by PHS_* environment variables")
+
+	metricFlags := addMetricFlags(flag.CommandLine)
 	flag.Parse()
 
 	if *versionFlag {
@@ -277,13 +261,13 @@ func main() {
 
 
 
-	promMux := mux.NewRouter()
+	appMux := mux.NewRouter()
 	tracer, err := newTracer()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	http.DefaultClient.Transport, err = zipkinhttp.NewTransport(
+	tracingTransport, err := zipkinhttp.NewTransport(
 		tracer,
 		zipkinhttp.TransportTrace(true))
 
@@ -294,12 +278,11 @@ func main() {
 
 
 
-	promMux.Handle("/metrics", promhttp.Handler())
-	promMux.HandleFunc("/", notFoundHandler)
-
-	go func() {
-		runPrometheusEndpoint(promMux, ":5201")
-	}()
+	metricsSrv := phsserver.NewMetricsServer(":5201",
+		phsserver.MetricsHandlerOpts{})
+	if err := metricsSrv.Start(); err != nil {
+		log.Fatal(err)
+	}
 
 	if port == nil {
 		p := 5080
@@ -307,32 +290,80 @@ func main() {
 	}
 
 
-	serverMetric := phsserver.NewDefaultServerMetrics()
+	cfg, err := phsserver.LoadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serverMetric, err := cfg.ServerMetrics()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metricFlags.apply(flag.CommandLine, serverMetric)
 	phsserver.ServerMetricsRegister(serverMetric)
 
-	clientMetric := phsserver.NewDefaultClientMetrics()
+	clientMetric, err := cfg.ClientMetrics()
+	if err != nil {
+		log.Fatal(err)
+	}
 	phsserver.ClientMetricsRegister(clientMetric)
 
-	expensiveHandler := http.HandlerFunc(expensive)
-	cheapHandler := http.HandlerFunc(cheap)
-
-	expensiveMeteredHandler := phsserver.WrapHandler(expensiveHandler, "XXX:EXPENSIVE", serverMetric)
-	cheapMeteredHandler := phsserver.WrapHandler(cheapHandler, "XXX:CHEAP", serverMetric)
+	// The demo's cheap handler fails with 500 now and then, retry those as
+	// well. The limit goes inside the breaker, which ignores its rejections.
+	retryPolicy := phsclient.NewDefaultRetryPolicy()
+	retryPolicy.RetryableCodes = append(retryPolicy.RetryableCodes,
+		http.StatusInternalServerError)
+	http.DefaultClient.Transport = phsserver.WrapTransport(
+		phsclient.NewRetryTransport(
+			phsclient.NewBreakerTransport(
+				phsclient.NewLimitTransport(tracingTransport, "webapp",
+					phsclient.NewDefaultLimitPolicy(), clientMetric),
+				"webapp", phsclient.NewDefaultBreakerPolicy(), clientMetric),
+			"webapp", retryPolicy, clientMetric),
+		"webapp", clientMetric)
+	externalService, err = NewSvcClient(nil,
+		fmt.Sprintf("http://localhost:%d/", *port))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	promMux.Handle("/expensive", expensiveMeteredHandler)
-	promMux.Handle("/cheap", cheapMeteredHandler)
+	appMux.HandleFunc("/expensive", expensive).Name("expensive")
+	appMux.HandleFunc("/cheap", cheap).Name("cheap")
+	appMux.NotFoundHandler = phsserver.WrapHandler(
+		http.HandlerFunc(notFoundHandler), phsserver.UnmatchedRoute, serverMetric)
 
 
-	promMux.Use(zipkinhttp.NewServerMiddleware(
+	appMux.Use(zipkinhttp.NewServerMiddleware(
 		tracer,
 		zipkinhttp.SpanName("webapp_request"),
 	))
+	appMux.Use(phsserver.MuxMiddleware(serverMetric))
 
 	srv := &http.Server{
-		Handler: promMux,
+		Handler: appMux,
 		Addr: fmt.Sprintf(":%d", *port),
 	}
 	fmt.Println("Hello.")
 
-	log.Fatal(srv.ListenAndServe())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown failed. err = %v", err)
+		}
+		if err := metricsSrv.Shutdown(ctx); err != nil {
+			log.Printf("Metrics shutdown failed. err = %v", err)
+		}
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
 }
@@ -0,0 +1,278 @@
+package phsclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.bofh.at/mla/phs/pkg/phsserver"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrCircuitOpen is returned for requests rejected by an open circuit
+// breaker.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitState is the state of a circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets all requests pass.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects all requests until the cool-down has passed.
+	CircuitOpen
+	// CircuitHalfOpen lets a few probe requests pass. If they succeed the
+	// circuit closes, otherwise it opens again.
+	CircuitHalfOpen
+)
+
+var circuitStates = []CircuitState{CircuitClosed, CircuitOpen, CircuitHalfOpen}
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	}
+	return "unknown"
+}
+
+// BreakerPolicy configures when a circuit breaker opens. Requests failing
+// without a response, including timeouts, or with a 5xx status count as
+// failures. Requests rejected by a concurrency limit with ErrLimitExceeded or
+// canceled by the caller say nothing about the endpoint and are not counted
+// at all.
+type BreakerPolicy struct {
+	// ConsecutiveFailures opens the circuit after this many failures in a
+	// row. 0 disables the check.
+	ConsecutiveFailures int
+
+	// FailureRatio opens the circuit if at least this fraction of the
+	// requests in the current Window failed, once MinRequests have been
+	// seen. 0 disables the check.
+	FailureRatio float64
+	MinRequests  int
+	Window       time.Duration
+
+	// CoolDown is how long an open circuit rejects requests before it
+	// turns half-open.
+	CoolDown time.Duration
+
+	// HalfOpenRequests is the number of probe requests let through when
+	// half-open. The circuit closes when all of them succeed.
+	HalfOpenRequests int
+}
+
+// NewDefaultBreakerPolicy returns a policy which opens after 5 consecutive
+// failures or a failure ratio of 50% over at least 20 requests in 10s, and
+// probes again with a single request after a cool-down of 5s.
+func NewDefaultBreakerPolicy() BreakerPolicy {
+	return BreakerPolicy{
+		ConsecutiveFailures: 5,
+		FailureRatio:        0.5,
+		MinRequests:         20,
+		Window:              10 * time.Second,
+		CoolDown:            5 * time.Second,
+		HalfOpenRequests:    1,
+	}
+}
+
+// breaker is the circuit breaker of a single endpoint.
+type breaker struct {
+	mu    sync.Mutex
+	state CircuitState
+	// generation changes with every transition, so results of requests
+	// allowed in an earlier state are ignored.
+	generation  uint64
+	consecutive int
+	total       int
+	failed      int
+	windowStart time.Time
+	openedAt    time.Time
+	probes      int
+	successes   int
+}
+
+// breakerTransport is a http.RoundTripper with a circuit breaker per
+// endpoint.
+type breakerTransport struct {
+	next     http.RoundTripper
+	endpoint string
+	p        BreakerPolicy
+	m        *phsserver.ClientMetrics
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// NewBreakerTransport returns a http.RoundTripper which guards every
+// endpoint with a circuit breaker configured by p. The endpoint is taken
+// from the request context, see phsserver.WithEndpoint, or else the one
+// passed here. While a circuit is open requests fail fast with
+// ErrCircuitOpen. The state of the breakers is exported with the
+// CircuitState and CircuitTransitions metrics of m. If next is nil,
+// http.DefaultTransport is used.
+//
+// A limit transport goes inside the breaker, see NewLimitTransport, so
+// requests rejected by an open circuit do not take a slot. Its rejections
+// are not counted as failures, see BreakerPolicy.
+func NewBreakerTransport(next http.RoundTripper, endpoint string, p BreakerPolicy, m *phsserver.ClientMetrics) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if p.HalfOpenRequests < 1 {
+		p.HalfOpenRequests = 1
+	}
+	return &breakerTransport{
+		next:     next,
+		endpoint: endpoint,
+		p:        p,
+		m:        m,
+		breakers: make(map[string]*breaker),
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := phsserver.EndpointFrom(req.Context())
+	if endpoint == "" {
+		endpoint = t.endpoint
+	}
+	b := t.breaker(endpoint)
+
+	gen, err := t.allow(b, endpoint, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case errors.Is(err, ErrLimitExceeded), errors.Is(err, context.Canceled):
+		t.release(b, gen)
+	default:
+		t.record(b, endpoint, gen, err != nil || resp.StatusCode >= 500, time.Now())
+	}
+	return resp, err
+}
+
+// breaker returns the breaker of endpoint, creating it if needed.
+func (t *breakerTransport) breaker(endpoint string) *breaker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.breakers[endpoint]
+	if !ok {
+		b = &breaker{windowStart: time.Now()}
+		t.breakers[endpoint] = b
+		t.setState(endpoint, CircuitClosed)
+	}
+	return b
+}
+
+// allow decides whether a request may pass b and returns the generation
+// the result must be recorded with.
+func (t *breakerTransport) allow(b *breaker, endpoint string, now time.Time) (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if now.Sub(b.openedAt) < t.p.CoolDown {
+			return 0, ErrCircuitOpen
+		}
+		t.transition(b, endpoint, CircuitHalfOpen, now)
+		fallthrough
+	case CircuitHalfOpen:
+		if b.probes >= t.p.HalfOpenRequests {
+			return 0, ErrCircuitOpen
+		}
+		b.probes++
+	}
+	return b.generation, nil
+}
+
+// release returns the probe slot of a request allowed in generation gen
+// without counting its result.
+func (t *breakerTransport) release(b *breaker, gen uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if gen == b.generation && b.state == CircuitHalfOpen {
+		b.probes--
+	}
+}
+
+// record updates b with the result of a request allowed in generation gen.
+func (t *breakerTransport) record(b *breaker, endpoint string, gen uint64, failed bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if gen != b.generation {
+		return
+	}
+	switch b.state {
+	case CircuitClosed:
+		if t.p.Window > 0 && now.Sub(b.windowStart) >= t.p.Window {
+			b.total, b.failed, b.windowStart = 0, 0, now
+		}
+		b.total++
+		if !failed {
+			b.consecutive = 0
+			return
+		}
+		b.failed++
+		b.consecutive++
+		if (t.p.ConsecutiveFailures > 0 && b.consecutive >= t.p.ConsecutiveFailures) ||
+			(t.p.FailureRatio > 0 && b.total >= t.p.MinRequests &&
+				float64(b.failed) >= t.p.FailureRatio*float64(b.total)) {
+			t.transition(b, endpoint, CircuitOpen, now)
+		}
+	case CircuitHalfOpen:
+		if failed {
+			t.transition(b, endpoint, CircuitOpen, now)
+			return
+		}
+		b.successes++
+		if b.successes >= t.p.HalfOpenRequests {
+			t.transition(b, endpoint, CircuitClosed, now)
+		}
+	}
+}
+
+// transition moves b to state to. b.mu must be held.
+func (t *breakerTransport) transition(b *breaker, endpoint string, to CircuitState, now time.Time) {
+	from := b.state
+	b.state = to
+	b.generation++
+	b.consecutive, b.total, b.failed, b.windowStart = 0, 0, 0, now
+	b.probes, b.successes = 0, 0
+	if to == CircuitOpen {
+		b.openedAt = now
+	}
+
+	if t.m != nil && t.m.CircuitTransitions != nil {
+		t.m.CircuitTransitions.With(prometheus.Labels{
+			"endpoint": endpoint,
+			"from":     from.String(),
+			"to":       to.String(),
+		}).Inc()
+	}
+	t.setState(endpoint, to)
+}
+
+// setState exports the current state of endpoint.
+func (t *breakerTransport) setState(endpoint string, current CircuitState) {
+	if t.m == nil || t.m.CircuitState == nil {
+		return
+	}
+	for _, s := range circuitStates {
+		v := 0.0
+		if s == current {
+			v = 1
+		}
+		t.m.CircuitState.With(prometheus.Labels{
+			"endpoint": endpoint,
+			"state":    s.String(),
+		}).Set(v)
+	}
+}
@@ -0,0 +1,172 @@
+// Package phsclient is a small framework for typed clients of JSON based
+// http services. Service clients embed or wrap a Client and add one method
+// per remote operation, every call is labeled with an endpoint id in the
+// client side metrics of phsserver.
+package phsclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"git.bofh.at/mla/phs/pkg/phsserver"
+)
+
+// maxErrorBody limits how much of an error response body is kept in an
+// ErrorResponse.
+const maxErrorBody = 64 << 10
+
+// Client sends requests to a remote service. Its http.Client is expected to
+// use a transport wrapped by phsserver.WrapTransport, which records the
+// metrics for every call.
+type Client struct {
+	client *http.Client
+
+	// BaseURL is the URL relative request paths are resolved against. It
+	// should end with a slash.
+	BaseURL *url.URL
+
+	// UserAgent is sent with every request if it is not empty.
+	UserAgent string
+}
+
+// NewClient returns a Client for the service at baseURL. If httpClient is
+// nil, http.DefaultClient is used.
+func NewClient(httpClient *http.Client, baseURL string) (*Client, error) {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base url %q: %w", baseURL, err)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &Client{
+		client:  httpClient,
+		BaseURL: u,
+	}, nil
+}
+
+// NewInstrumentedClient returns a Client for the service at baseURL whose
+// requests are sent through http.DefaultTransport wrapped with
+// phsserver.WrapTransport. Calls without an endpoint id are labeled with
+// service.
+func NewInstrumentedClient(baseURL, service string, m *phsserver.ClientMetrics) (*Client, error) {
+	return NewClient(&http.Client{
+		Transport: phsserver.WrapTransport(nil, service, m),
+	}, baseURL)
+}
+
+// NewRequest creates a request for urlStr, which is resolved against
+// BaseURL. A non-nil body is encoded as JSON.
+func (c *Client) NewRequest(ctx context.Context, method, urlStr string, body interface{}) (*http.Request, error) {
+	rel, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	u := c.BaseURL.ResolveReference(rel)
+
+	var buf io.Reader
+	if body != nil {
+		b := new(bytes.Buffer)
+		if err := json.NewEncoder(b).Encode(body); err != nil {
+			return nil, fmt.Errorf("cannot encode request body: %w", err)
+		}
+		buf = b
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), buf)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	return req, nil
+}
+
+// Do sends req and labels it with endpointID in the client metrics. A
+// successful response is decoded as JSON into v, or copied to v if it is an
+// io.Writer; v may be nil to discard the body. Responses with a status
+// outside of 2xx are returned together with an *ErrorResponse. The body of
+// the returned response is always closed.
+func (c *Client) Do(ctx context.Context, endpointID string, req *http.Request, v interface{}) (*http.Response, error) {
+	if endpointID != "" {
+		ctx = phsserver.WithEndpoint(ctx, endpointID)
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := CheckResponse(resp); err != nil {
+		return resp, err
+	}
+
+	switch v := v.(type) {
+	case nil:
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+	case io.Writer:
+		_, err = io.Copy(v, resp.Body)
+	default:
+		err = json.NewDecoder(resp.Body).Decode(v)
+		if err == io.EOF {
+			err = nil // empty body
+		}
+		if err != nil {
+			err = fmt.Errorf("cannot decode response body: %w", err)
+		}
+	}
+	return resp, err
+}
+
+// ErrorResponse is returned by Do for responses with a status outside of
+// 2xx.
+type ErrorResponse struct {
+	// Response is the response which caused the error. Its body has been
+	// read and closed.
+	Response *http.Response
+
+	// Message is the "message" field of a JSON error body, if there is one.
+	Message string `json:"message"`
+
+	// Body holds the start of the response body.
+	Body []byte `json:"-"`
+}
+
+func (r *ErrorResponse) Error() string {
+	msg := r.Message
+	if msg == "" {
+		msg = strings.TrimSpace(string(r.Body))
+	}
+	return fmt.Sprintf("%s %s: %d %s",
+		r.Response.Request.Method, r.Response.Request.URL,
+		r.Response.StatusCode, msg)
+}
+
+// CheckResponse returns an *ErrorResponse if the status of r is not 2xx.
+func CheckResponse(r *http.Response) error {
+	if r.StatusCode >= 200 && r.StatusCode < 300 {
+		return nil
+	}
+	e := &ErrorResponse{Response: r}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxErrorBody))
+	if err == nil && len(body) > 0 {
+		e.Body = body
+		json.Unmarshal(body, e)
+	}
+	return e
+}
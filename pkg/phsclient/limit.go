@@ -0,0 +1,280 @@
+package phsclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.bofh.at/mla/phs/pkg/phsserver"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrLimitExceeded is returned for requests rejected by a concurrency
+// limiter, because its queue is full or the request waited too long.
+var ErrLimitExceeded = errors.New("concurrency limit exceeded")
+
+// LimitPolicy configures the concurrency limit of an endpoint.
+type LimitPolicy struct {
+	// Limit is the number of concurrent requests. For adaptive limits it
+	// is the initial limit.
+	Limit int
+
+	// Adaptive adjusts the limit by additive increase, multiplicative
+	// decrease (AIMD): every successful request raises it by 1/limit,
+	// every overloaded one multiplies it by Backoff. The limit stays
+	// between MinLimit and MaxLimit.
+	Adaptive bool
+	MinLimit int
+	MaxLimit int
+	Backoff  float64
+
+	// LatencyThreshold marks responses which took longer as overloaded
+	// for adaptive limits. Transport errors, 429 and 503 responses are
+	// always taken as overload. 0 disables the latency check.
+	LatencyThreshold time.Duration
+
+	// MaxQueue is the number of requests waiting for a free slot, further
+	// requests are rejected immediately. QueueTimeout limits the wait.
+	MaxQueue     int
+	QueueTimeout time.Duration
+}
+
+// NewDefaultLimitPolicy returns a fixed limit of 20 concurrent requests
+// with up to 20 more waiting at most 1s.
+func NewDefaultLimitPolicy() LimitPolicy {
+	return LimitPolicy{
+		Limit:        20,
+		MinLimit:     1,
+		MaxLimit:     200,
+		Backoff:      0.9,
+		MaxQueue:     20,
+		QueueTimeout: time.Second,
+	}
+}
+
+// limiter limits the concurrent requests of a single endpoint.
+type limiter struct {
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	waiters  []chan struct{}
+}
+
+// limitTransport is a http.RoundTripper with a concurrency limit per
+// endpoint.
+type limitTransport struct {
+	next     http.RoundTripper
+	endpoint string
+	p        LimitPolicy
+	m        *phsserver.ClientMetrics
+
+	mu       sync.Mutex
+	limiters map[string]*limiter
+}
+
+// NewLimitTransport returns a http.RoundTripper which limits the concurrent
+// requests of every endpoint as configured by p, so a slow dependency
+// cannot tie up all callers. The endpoint is taken from the request context,
+// see phsserver.WithEndpoint, or else the one passed here. A request holds
+// its slot until the response body is closed. Requests which cannot be
+// queued or time out waiting fail with ErrLimitExceeded. The limiters are
+// exported with the ReqInflight, ReqQueued, ReqRejected and
+// ConcurrencyLimit metrics of m. If next is nil, http.DefaultTransport is
+// used.
+//
+// Put the limit inside the circuit breaker and the retries, e.g.
+// NewRetryTransport(NewBreakerTransport(NewLimitTransport(...))). Both
+// pass ErrLimitExceeded on as it is: it is neither retried nor counted as
+// a failure of the endpoint.
+func NewLimitTransport(next http.RoundTripper, endpoint string, p LimitPolicy, m *phsserver.ClientMetrics) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if p.Limit < 1 {
+		p.Limit = 1
+	}
+	if p.MinLimit < 1 {
+		p.MinLimit = 1
+	}
+	if p.MaxLimit < p.Limit {
+		p.MaxLimit = p.Limit
+	}
+	if p.Backoff <= 0 || p.Backoff >= 1 {
+		p.Backoff = 0.9
+	}
+	return &limitTransport{
+		next:     next,
+		endpoint: endpoint,
+		p:        p,
+		m:        m,
+		limiters: make(map[string]*limiter),
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := phsserver.EndpointFrom(req.Context())
+	if endpoint == "" {
+		endpoint = t.endpoint
+	}
+	l := t.limiter(endpoint)
+
+	if err := t.acquire(req.Context(), l, endpoint); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	overload := err != nil
+	if err == nil {
+		overload = resp.StatusCode == http.StatusTooManyRequests ||
+			resp.StatusCode == http.StatusServiceUnavailable ||
+			(t.p.LatencyThreshold > 0 && time.Since(start) > t.p.LatencyThreshold)
+	}
+	if errors.Is(err, context.Canceled) {
+		overload = false
+	}
+	// The body of an upgraded connection must stay writable.
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		t.release(l, endpoint, overload)
+		return resp, err
+	}
+	resp.Body = &releaseBody{
+		ReadCloser: resp.Body,
+		release:    func() { t.release(l, endpoint, overload) },
+	}
+	return resp, nil
+}
+
+// limiter returns the limiter of endpoint, creating it if needed.
+func (t *limitTransport) limiter(endpoint string) *limiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.limiters[endpoint]
+	if !ok {
+		l = &limiter{limit: float64(t.p.Limit)}
+		t.limiters[endpoint] = l
+		if t.m != nil && t.m.ConcurrencyLimit != nil {
+			t.m.ConcurrencyLimit.With(t.labels(endpoint)).Set(l.limit)
+		}
+	}
+	return l
+}
+
+// acquire takes a slot of l, waiting in its queue if needed.
+func (t *limitTransport) acquire(ctx context.Context, l *limiter, endpoint string) error {
+	l.mu.Lock()
+	if len(l.waiters) == 0 && l.inflight < int(l.limit) {
+		l.inflight++
+		t.setInflight(l, endpoint)
+		l.mu.Unlock()
+		return nil
+	}
+	if len(l.waiters) >= t.p.MaxQueue {
+		l.mu.Unlock()
+		t.reject(endpoint, "queue_full")
+		return ErrLimitExceeded
+	}
+	ch := make(chan struct{})
+	l.waiters = append(l.waiters, ch)
+	t.setQueued(l, endpoint)
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if t.p.QueueTimeout > 0 {
+		timer := time.NewTimer(t.p.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		err = ErrLimitExceeded
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, w := range l.waiters {
+		if w == ch {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			t.setQueued(l, endpoint)
+			if err == ErrLimitExceeded {
+				t.reject(endpoint, "timeout")
+			}
+			return err
+		}
+	}
+	// The slot was granted while giving up.
+	return nil
+}
+
+// release returns a slot to l, adapts the limit and hands free slots to
+// the queue.
+func (t *limitTransport) release(l *limiter, endpoint string, overload bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	if t.p.Adaptive {
+		if overload {
+			l.limit = math.Max(float64(t.p.MinLimit), l.limit*t.p.Backoff)
+		} else {
+			l.limit = math.Min(float64(t.p.MaxLimit), l.limit+1/l.limit)
+		}
+		if t.m != nil && t.m.ConcurrencyLimit != nil {
+			t.m.ConcurrencyLimit.With(t.labels(endpoint)).Set(l.limit)
+		}
+	}
+	for len(l.waiters) > 0 && l.inflight < int(l.limit) {
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+		l.inflight++
+	}
+	t.setQueued(l, endpoint)
+	t.setInflight(l, endpoint)
+}
+
+func (t *limitTransport) labels(endpoint string) prometheus.Labels {
+	return prometheus.Labels{"endpoint": endpoint}
+}
+
+func (t *limitTransport) setInflight(l *limiter, endpoint string) {
+	if t.m != nil && t.m.ReqInflight != nil {
+		t.m.ReqInflight.With(t.labels(endpoint)).Set(float64(l.inflight))
+	}
+}
+
+func (t *limitTransport) setQueued(l *limiter, endpoint string) {
+	if t.m != nil && t.m.ReqQueued != nil {
+		t.m.ReqQueued.With(t.labels(endpoint)).Set(float64(len(l.waiters)))
+	}
+}
+
+func (t *limitTransport) reject(endpoint, reason string) {
+	if t.m != nil && t.m.ReqRejected != nil {
+		t.m.ReqRejected.With(prometheus.Labels{
+			"endpoint": endpoint,
+			"reason":   reason,
+		}).Inc()
+	}
+}
+
+// releaseBody releases the slot of a request once its body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
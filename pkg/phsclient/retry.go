@@ -0,0 +1,224 @@
+package phsclient
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.bofh.at/mla/phs/pkg/phsserver"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RetryPolicy configures how failed requests are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one. Values
+	// below 2 disable retries.
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the first retry. It grows by
+	// Multiplier for every further retry up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+
+	// Jitter is the fraction, between 0 and 1, by which a backoff is
+	// randomly shortened so clients don't retry in lockstep. Values out of
+	// range are clamped.
+	Jitter float64
+
+	// MaxRetryAfter is the longest wait requested by a Retry-After header
+	// which is honored, responses asking for more are not retried. If it is
+	// 0, MaxBackoff is the limit.
+	MaxRetryAfter time.Duration
+
+	// RetryableCodes are the status codes which are retried.
+	RetryableCodes []int
+}
+
+// NewDefaultRetryPolicy returns a policy with 3 attempts, backing off from
+// 100ms up to 2s, which retries 429, 502, 503 and 504 responses and honors
+// Retry-After headers up to 10s.
+func NewDefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		MaxRetryAfter:  10 * time.Second,
+		RetryableCodes: []int{
+			http.StatusTooManyRequests,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+}
+
+// backoff returns the wait before the given retry, counting from 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(retry-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d -= d * p.Jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// maxRetryAfter returns the longest honored Retry-After wait.
+func (p RetryPolicy) maxRetryAfter() time.Duration {
+	if p.MaxRetryAfter > 0 {
+		return p.MaxRetryAfter
+	}
+	return p.MaxBackoff
+}
+
+// retryable returns whether a request with the given method which failed
+// with err or returned code may be sent again. Idempotent methods are
+// retried after transport errors and on all RetryableCodes. Other methods
+// are only retried on 429 and 503, which tell that the request has not been
+// processed.
+func (p RetryPolicy) retryable(method string, code int, err error) bool {
+	idempotent := false
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		idempotent = true
+	}
+	if err != nil {
+		return idempotent
+	}
+	for _, c := range p.RetryableCodes {
+		if c != code {
+			continue
+		}
+		return idempotent ||
+			code == http.StatusTooManyRequests ||
+			code == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// retryTransport is a http.RoundTripper retrying failed requests.
+type retryTransport struct {
+	next     http.RoundTripper
+	endpoint string
+	p        RetryPolicy
+	m        *phsserver.ClientMetrics
+}
+
+// NewRetryTransport returns a http.RoundTripper which retries failed
+// requests according to p. Every retry is counted in the Retries metric of
+// m, labeled with the endpoint from the request context or, if there is
+// none, with endpoint. To count only the final outcome of a call in the
+// request metrics, wrap the returned transport with
+// phsserver.WrapTransport. If next is nil, http.DefaultTransport is used.
+func NewRetryTransport(next http.RoundTripper, endpoint string, p RetryPolicy, m *phsserver.ClientMetrics) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	p.Jitter = math.Min(math.Max(p.Jitter, 0), 1)
+	return &retryTransport{
+		next:     next,
+		endpoint: endpoint,
+		p:        p,
+		m:        m,
+	}
+}
+
+// RoundTrip implements http.RoundTripper. Requests rejected by an open
+// circuit breaker or a concurrency limit are not retried. Requests with a
+// body are only retried if the body can be recreated with GetBody. Retries
+// stop when the wait would exceed the deadline of the request context or a
+// Retry-After header asks for more than MaxRetryAfter, the last response or
+// error is returned then.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+
+		code := 0
+		if err == nil {
+			code = resp.StatusCode
+		}
+		if attempt >= t.p.MaxAttempts || ctx.Err() != nil ||
+			errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrLimitExceeded) ||
+			!t.p.retryable(req.Method, code, err) ||
+			(req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+			return resp, err
+		}
+
+		wait := t.p.backoff(attempt)
+		if err == nil {
+			if ra, ok := retryAfter(resp); ok && ra > wait {
+				if ra > t.p.maxRetryAfter() {
+					return resp, err
+				}
+				wait = ra
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return resp, err
+		}
+
+		next := req
+		if req.GetBody != nil {
+			body, gerr := req.GetBody()
+			if gerr != nil {
+				return resp, err
+			}
+			next = req.Clone(ctx)
+			next.Body = body
+		}
+
+		reason := "error"
+		if err == nil {
+			reason = strconv.Itoa(code)
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxErrorBody))
+			resp.Body.Close()
+		}
+		if t.m != nil && t.m.Retries != nil {
+			endpoint := phsserver.EndpointFrom(ctx)
+			if endpoint == "" {
+				endpoint = t.endpoint
+			}
+			t.m.Retries.With(prometheus.Labels{
+				"method":   phsserver.SanitizeMethod(req.Method),
+				"endpoint": endpoint,
+				"reason":   reason,
+			}).Inc()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		req = next
+	}
+}
+
+// retryAfter returns the wait requested by the Retry-After header of resp,
+// given either in seconds or as http date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
@@ -0,0 +1,228 @@
+package phsserver
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Priority is the class of a request for the admission control. When a
+// handler is overloaded, requests with a lower priority are shed first.
+type Priority int
+
+const (
+	// PriorityLow requests are shed first.
+	PriorityLow Priority = iota
+	// PriorityNormal is the priority of requests which are not classified.
+	PriorityNormal
+	// PriorityHigh requests are queued ahead of lower priorities and
+	// evict them from a full queue.
+	PriorityHigh
+	// PriorityCritical requests, e.g. health checks, are never shed and
+	// are served even above the in-flight limit.
+	PriorityCritical
+)
+
+var priorityNames = map[Priority]string{
+	PriorityLow:      "low",
+	PriorityNormal:   "normal",
+	PriorityHigh:     "high",
+	PriorityCritical: "critical",
+}
+
+func (p Priority) String() string {
+	if n, ok := priorityNames[p]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+// PriorityFromHeader returns a function for AdmissionPolicy.Priority which
+// reads the priority from the request header name. Its value is one of
+// "low", "normal", "high" or "critical", anything else is normal.
+func PriorityFromHeader(name string) func(*http.Request) Priority {
+	return func(r *http.Request) Priority {
+		v := strings.ToLower(r.Header.Get(name))
+		for p, n := range priorityNames {
+			if n == v {
+				return p
+			}
+		}
+		return PriorityNormal
+	}
+}
+
+// AdmissionPolicy configures the load shedding of the handlers wrapped by
+// WrapHandler.
+type AdmissionPolicy struct {
+	// MaxInflight is the number of requests a handler serves at once.
+	MaxInflight int
+
+	// MaxQueue requests wait for a free slot, in the order of their
+	// priority, for at most QueueTimeout or until their context is done.
+	MaxQueue     int
+	QueueTimeout time.Duration
+
+	// RetryAfter is sent in the Retry-After header of shed requests. It is
+	// rounded up to full seconds, 0 omits the header.
+	RetryAfter time.Duration
+
+	// Priority classifies requests. All requests are PriorityNormal if it
+	// is nil.
+	Priority func(*http.Request) Priority
+}
+
+// waiter is a request queued for admission.
+type waiter struct {
+	priority Priority
+	ch       chan struct{}
+	evicted  bool
+}
+
+// admissionHandler sheds the load of a single handler.
+type admissionHandler struct {
+	next http.Handler
+	name string
+	p    *AdmissionPolicy
+	m    *ServerMetrics
+
+	mu sync.Mutex
+	// inflight counts the admitted requests of all methods, the ones the
+	// in-flight gauges see.
+	inflight int
+	// queue is ordered by descending priority, first come first served
+	// within a priority.
+	queue []*waiter
+}
+
+// admit wraps next with the admission control of m, if there is any.
+func (m *ServerMetrics) admit(next http.Handler, name string) http.Handler {
+	if m.Admission == nil {
+		return next
+	}
+	return &admissionHandler{
+		next: next,
+		name: name,
+		p:    m.Admission,
+		m:    m,
+	}
+}
+
+func (h *admissionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	priority := PriorityNormal
+	if h.p.Priority != nil {
+		priority = h.p.Priority(r)
+	}
+	if reason := h.acquire(r.Context(), priority); reason != "" {
+		h.shed(w, priority, reason)
+		return
+	}
+	defer h.release()
+	h.next.ServeHTTP(w, r)
+}
+
+// acquire admits a request of priority, queueing it if needed. It returns
+// the reason if the request is shed.
+func (h *admissionHandler) acquire(ctx context.Context, priority Priority) string {
+	h.mu.Lock()
+	if priority == PriorityCritical ||
+		(len(h.queue) == 0 && h.inflight < h.p.MaxInflight) {
+		h.inflight++
+		h.mu.Unlock()
+		return ""
+	}
+	if len(h.queue) >= h.p.MaxQueue {
+		last := len(h.queue) - 1
+		if last < 0 || h.queue[last].priority >= priority {
+			h.mu.Unlock()
+			return "queue_full"
+		}
+		h.queue[last].evicted = true
+		close(h.queue[last].ch)
+		h.queue = h.queue[:last]
+	}
+	wt := &waiter{priority: priority, ch: make(chan struct{})}
+	i := len(h.queue)
+	for i > 0 && h.queue[i-1].priority < priority {
+		i--
+	}
+	h.queue = append(h.queue, nil)
+	copy(h.queue[i+1:], h.queue[i:])
+	h.queue[i] = wt
+	h.setQueued()
+	h.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if h.p.QueueTimeout > 0 {
+		timer := time.NewTimer(h.p.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	reason := ""
+	select {
+	case <-wt.ch:
+	case <-timeout:
+		reason = "timeout"
+	case <-ctx.Done():
+		reason = "canceled"
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	defer h.setQueued()
+	if wt.evicted {
+		return "evicted"
+	}
+	for i, q := range h.queue {
+		if q == wt {
+			h.queue = append(h.queue[:i], h.queue[i+1:]...)
+			return reason
+		}
+	}
+	// Admitted while giving up.
+	return ""
+}
+
+// release frees the slot of a request and admits the next queued one.
+func (h *admissionHandler) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.inflight--
+	for len(h.queue) > 0 && h.inflight < h.p.MaxInflight {
+		close(h.queue[0].ch)
+		h.queue = h.queue[1:]
+		h.inflight++
+	}
+	h.setQueued()
+}
+
+// setQueued exports the queue length. h.mu must be held.
+func (h *admissionHandler) setQueued() {
+	if h.m.ReqQueued != nil {
+		h.m.ReqQueued.With(prometheus.Labels{"handler": h.name}).
+			Set(float64(len(h.queue)))
+	}
+}
+
+// shed answers a request which is not admitted.
+func (h *admissionHandler) shed(w http.ResponseWriter, priority Priority, reason string) {
+	if h.m.ReqShed != nil {
+		h.m.ReqShed.With(prometheus.Labels{
+			"handler":  h.name,
+			"priority": priority.String(),
+			"reason":   reason,
+		}).Inc()
+	}
+	if h.p.RetryAfter > 0 {
+		w.Header().Set("Retry-After",
+			strconv.Itoa(int(math.Ceil(h.p.RetryAfter.Seconds()))))
+	}
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable),
+		http.StatusServiceUnavailable)
+}
@@ -0,0 +1,209 @@
+package phsserver
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxGeneratedBuckets is the largest number of buckets a generator may
+// produce. It keeps a mistyped count in the configuration from allocating
+// huge layouts.
+const MaxGeneratedBuckets = 1000
+
+// NewLinearBuckets returns count buckets, the first with the upper bound
+// start, each following one width wider than the previous one. It panics if
+// count is less than one or width is not positive.
+func NewLinearBuckets(start, width float64, count int) BucketConfig {
+	b, err := linearBuckets(start, width, count)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// NewExponentialBuckets returns count buckets, the first with the upper
+// bound start, each following one factor times as wide as the previous one.
+// It panics if count is less than one, start is not positive or factor is
+// not greater than one.
+func NewExponentialBuckets(start, factor float64, count int) BucketConfig {
+	b, err := exponentialBuckets(start, factor, count)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// NewDecadeBuckets returns perDecade logarithmically spaced buckets for each
+// power of ten, starting at min and ending with the last bound not greater
+// than max. The bounds are rounded to 6 significant digits. It panics if min
+// is not positive, max is less than min or perDecade is less than one.
+func NewDecadeBuckets(min, max float64, perDecade int) BucketConfig {
+	b, err := decadeBuckets(min, max, perDecade)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// NewSLOBuckets returns the buckets of base with the latency targets added
+// as bucket boundaries, so that the share of requests faster than a target
+// can be read exactly from the histogram. Targets which already are
+// boundaries are not duplicated.
+func NewSLOBuckets(base BucketConfig, targets ...float64) BucketConfig {
+	seen := make(map[float64]bool)
+	b := make(BucketConfig, 0, len(base)+len(targets))
+	for _, v := range append(append([]float64{}, base...), targets...) {
+		if !seen[v] {
+			seen[v] = true
+			b = append(b, v)
+		}
+	}
+	sort.Float64s(b)
+	return b
+}
+
+func linearBuckets(start, width float64, count int) (BucketConfig, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("linear buckets need a count of at least 1, got %d", count)
+	}
+	if count > MaxGeneratedBuckets {
+		return nil, fmt.Errorf("linear buckets count %d exceeds the limit of %d", count, MaxGeneratedBuckets)
+	}
+	if width <= 0 {
+		return nil, fmt.Errorf("linear buckets need a positive width, got %g", width)
+	}
+	b := make(BucketConfig, count)
+	for i := range b {
+		b[i] = roundSig(start+float64(i)*width, 12)
+	}
+	return b, nil
+}
+
+func exponentialBuckets(start, factor float64, count int) (BucketConfig, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("exponential buckets need a count of at least 1, got %d", count)
+	}
+	if count > MaxGeneratedBuckets {
+		return nil, fmt.Errorf("exponential buckets count %d exceeds the limit of %d", count, MaxGeneratedBuckets)
+	}
+	if start <= 0 {
+		return nil, fmt.Errorf("exponential buckets need a positive start, got %g", start)
+	}
+	if factor <= 1 {
+		return nil, fmt.Errorf("exponential buckets need a factor greater than 1, got %g", factor)
+	}
+	b := make(BucketConfig, count)
+	v := start
+	for i := range b {
+		b[i] = roundSig(v, 12)
+		v *= factor
+	}
+	return b, nil
+}
+
+func decadeBuckets(min, max float64, perDecade int) (BucketConfig, error) {
+	if min <= 0 {
+		return nil, fmt.Errorf("decade buckets need a positive minimum, got %g", min)
+	}
+	if max < min {
+		return nil, fmt.Errorf("decade buckets need a maximum not less than %g, got %g", min, max)
+	}
+	if perDecade < 1 {
+		return nil, fmt.Errorf("decade buckets need at least 1 bucket per decade, got %d", perDecade)
+	}
+	b := make(BucketConfig, 0)
+	for i := 0; ; i++ {
+		v := roundSig(min*math.Pow(10, float64(i)/float64(perDecade)), 6)
+		if v > max {
+			break
+		}
+		if len(b) == MaxGeneratedBuckets {
+			return nil, fmt.Errorf("decade buckets exceed the limit of %d", MaxGeneratedBuckets)
+		}
+		b = append(b, v)
+	}
+	return b, nil
+}
+
+// roundSig rounds v to digits significant digits, which removes the noise
+// of the floating point arithmetic from generated bounds.
+func roundSig(v float64, digits int) float64 {
+	r, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'g', digits, 64), 64)
+	return r
+}
+
+// parseGenerator expands a generator expression like exp(1ms,2,12) of a
+// bucket configuration string. ok is false if s is not a generator
+// expression. Bounds may have unit suffixes, see parseValue, counts and
+// factors may not. The slo generator is not expanded, its arguments are
+// returned as targets instead, because they are merged into the complete
+// layout.
+func parseGenerator(s string) (b BucketConfig, targets []float64, ok bool, err error) {
+	open := strings.Index(s, "(")
+	if open < 0 || !strings.HasSuffix(s, ")") {
+		return nil, nil, false, nil
+	}
+	name := strings.TrimSpace(s[:open])
+	args := strings.Split(s[open+1:len(s)-1], ",")
+	for i := range args {
+		args[i] = strings.TrimSpace(args[i])
+	}
+
+	value := func(i int) float64 {
+		f, e := parseValue(args[i])
+		if e != nil && err == nil {
+			err = e
+		}
+		return f
+	}
+	factor := func(i int) float64 {
+		f, e := strconv.ParseFloat(args[i], 64)
+		if e != nil && err == nil {
+			err = fmt.Errorf("cannot parse factor %q into float", args[i])
+		}
+		return f
+	}
+	count := func(i int) int {
+		n, e := strconv.Atoi(args[i])
+		if e != nil && err == nil {
+			err = fmt.Errorf("cannot parse count %q into integer", args[i])
+		}
+		return n
+	}
+
+	switch name {
+	case "lin", "exp", "log":
+		if len(args) != 3 {
+			return nil, nil, true, fmt.Errorf("%s needs 3 arguments, got %d", name, len(args))
+		}
+	case "slo":
+	default:
+		return nil, nil, true, fmt.Errorf("unknown bucket generator %q", name)
+	}
+
+	switch name {
+	case "lin":
+		start, width, n := value(0), value(1), count(2)
+		if err == nil {
+			b, err = linearBuckets(start, width, n)
+		}
+	case "exp":
+		start, f, n := value(0), factor(1), count(2)
+		if err == nil {
+			b, err = exponentialBuckets(start, f, n)
+		}
+	case "log":
+		min, max, n := value(0), value(1), count(2)
+		if err == nil {
+			b, err = decadeBuckets(min, max, n)
+		}
+	case "slo":
+		for i := range args {
+			targets = append(targets, value(i))
+		}
+	}
+	return b, targets, true, err
+}
@@ -0,0 +1,146 @@
+package phsserver
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// clientTransport is a http.RoundTripper which collects the client side
+// metrics for every request passed through it.
+type clientTransport struct {
+	next     http.RoundTripper
+	endpoint string
+	m        *ClientMetrics
+}
+
+// WrapTransport encapsulates a http.RoundTripper which collects prometheus
+// metrics for outgoing requests. The endpoint is the name of the remote
+// service and is used as value of the endpoint label. If rt is nil,
+// http.DefaultTransport is used.
+func WrapTransport(rt http.RoundTripper, endpoint string, m *ClientMetrics) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &clientTransport{
+		next:     rt,
+		endpoint: endpoint,
+		m:        m,
+	}
+}
+
+// RoundTrip implements http.RoundTripper. The action label is taken from the
+// request context, see ActionFrom, and set to "unknown" if there is none. An
+// endpoint stored in the context with WithEndpoint takes precedence over the
+// one of the transport.
+// Requests which fail without a response are counted with the code label set
+// to "error".
+func (t *clientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	endpoint := EndpointFrom(req.Context())
+	if endpoint == "" {
+		endpoint = t.endpoint
+	}
+	if t.m.Connections != nil || t.m.TimeToFirstByte != nil {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(),
+			t.trace(start, endpoint)))
+	}
+	resp, err := t.next.RoundTrip(req)
+	d := time.Since(start).Seconds()
+
+	action := ActionFrom(req.Context())
+	if action == "" {
+		action = "unknown"
+	}
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	l := prometheus.Labels{
+		"code":     code,
+		"method":   SanitizeMethod(req.Method),
+		"endpoint": endpoint,
+		"action":   action,
+	}
+
+	e := t.m.exemplar()(req.Context())
+	if t.m.ReqCounter != nil {
+		inc(t.m.ReqCounter.With(l), e)
+	}
+	if t.m.ReqDurationHisto != nil {
+		observe(t.m.ReqDurationHisto.With(l), d, e)
+	}
+	if t.m.ReqDurationPercentiles != nil {
+		t.m.ReqDurationPercentiles.With(l).Observe(d)
+	}
+	return resp, err
+}
+
+// trace returns a httptrace.ClientTrace feeding the connection metrics. The
+// time to first byte is measured from start.
+func (t *clientTransport) trace(start time.Time, endpoint string) *httptrace.ClientTrace {
+	l := prometheus.Labels{"endpoint": endpoint}
+	since := func(o *prometheus.HistogramVec, begin time.Time) {
+		if o != nil && !begin.IsZero() {
+			o.With(l).Observe(time.Since(begin).Seconds())
+		}
+	}
+
+	var mu sync.Mutex
+	var dnsStart, tlsStart time.Time
+	connectStart := make(map[string]time.Time)
+
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = time.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			since(t.m.DNSDuration, dnsStart)
+		},
+		// Several addresses may be dialed in parallel.
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			connectStart[network+addr] = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				since(t.m.ConnectDuration, connectStart[network+addr])
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				since(t.m.TLSDuration, tlsStart)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if t.m.Connections != nil {
+				t.m.Connections.With(prometheus.Labels{
+					"endpoint": endpoint,
+					"reused":   strconv.FormatBool(info.Reused),
+				}).Inc()
+			}
+		},
+		GotFirstResponseByte: func() {
+			since(t.m.TimeToFirstByte, start)
+		},
+	}
+}
@@ -0,0 +1,371 @@
+package phsserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Names of the metric families which can be disabled in the configuration.
+const (
+	FamilyRequestDuration            = "request_duration"
+	FamilyRequestDurationPercentiles = "request_duration_percentiles"
+	FamilyRequestSize                = "request_size"
+	FamilyResponseSize               = "response_size"
+	FamilyTimeToWriteHeader          = "time_to_write_header"
+	FamilyTimeToFirstByte            = "time_to_first_byte"
+	FamilyConnection                 = "connection"
+)
+
+// Config is the configuration of the server and client side metrics, as
+// read by LoadConfig. Bucket layouts and percentiles are strings in the
+// syntax of NewBucketConfig and NewPercentileConfig. Layouts which are not
+// set keep their defaults, an empty layout disables the metric family.
+type Config struct {
+	Server ServerConfig `yaml:"server" json:"server"`
+	Client ClientConfig `yaml:"client" json:"client"`
+}
+
+// ServerConfig is the configuration of the server side metrics.
+type ServerConfig struct {
+	Namespace   string            `yaml:"namespace" json:"namespace"`
+	Subsystem   string            `yaml:"subsystem" json:"subsystem"`
+	ConstLabels map[string]string `yaml:"const_labels" json:"const_labels"`
+
+	RequestDurationBuckets     *BucketConfig     `yaml:"request_duration_buckets" json:"request_duration_buckets"`
+	RequestDurationPercentiles *PercentileConfig `yaml:"request_duration_percentiles" json:"request_duration_percentiles"`
+	RequestSizeBuckets         *BucketConfig     `yaml:"request_size_buckets" json:"request_size_buckets"`
+	ResponseSizeBuckets        *BucketConfig     `yaml:"response_size_buckets" json:"response_size_buckets"`
+	TimeToWriteHeaderBuckets   *BucketConfig     `yaml:"time_to_write_header_buckets" json:"time_to_write_header_buckets"`
+	TimeToFirstByteBuckets     *BucketConfig     `yaml:"time_to_first_byte_buckets" json:"time_to_first_byte_buckets"`
+
+	NativeHistogramBucketFactor float64 `yaml:"native_histogram_bucket_factor" json:"native_histogram_bucket_factor"`
+
+	// SLOs are the service level objectives of the handlers, SLOWindows
+	// the durations their burn rates are computed over, e.g. "5m;1h".
+	SLOs       []SLOConfig `yaml:"slos" json:"slos"`
+	SLOWindows string      `yaml:"slo_windows" json:"slo_windows"`
+
+	// InflightAggregate registers the in-flight gauge over all handlers
+	// in addition to the one per handler.
+	InflightAggregate bool `yaml:"inflight_aggregate" json:"inflight_aggregate"`
+
+	// Disable lists the metric families which are not registered.
+	Disable []string `yaml:"disable" json:"disable"`
+}
+
+// SLOConfig is the configuration of a SLO. The latency threshold is a value
+// with time unit like "300ms", empty for availability only.
+type SLOConfig struct {
+	Handler          string   `yaml:"handler" json:"handler"`
+	Target           float64  `yaml:"target" json:"target"`
+	LatencyThreshold string   `yaml:"latency_threshold" json:"latency_threshold"`
+	ErrorCodes       []string `yaml:"error_codes" json:"error_codes"`
+}
+
+// ClientConfig is the configuration of the client side metrics.
+type ClientConfig struct {
+	Namespace   string            `yaml:"namespace" json:"namespace"`
+	Subsystem   string            `yaml:"subsystem" json:"subsystem"`
+	ConstLabels map[string]string `yaml:"const_labels" json:"const_labels"`
+
+	RequestDurationBuckets     *BucketConfig     `yaml:"request_duration_buckets" json:"request_duration_buckets"`
+	RequestDurationPercentiles *PercentileConfig `yaml:"request_duration_percentiles" json:"request_duration_percentiles"`
+	ConnectionBuckets          *BucketConfig     `yaml:"connection_buckets" json:"connection_buckets"`
+	TimeToFirstByteBuckets     *BucketConfig     `yaml:"time_to_first_byte_buckets" json:"time_to_first_byte_buckets"`
+
+	NativeHistogramBucketFactor float64 `yaml:"native_histogram_bucket_factor" json:"native_histogram_bucket_factor"`
+
+	// Disable lists the metric families which are not registered.
+	Disable []string `yaml:"disable" json:"disable"`
+}
+
+// LoadConfig reads the configuration from the file path, which is parsed as
+// JSON if its name ends in .json and as YAML otherwise. An empty path reads
+// no file. Afterwards the PHS_SERVER_* and PHS_CLIENT_* environment variables
+// override the settings of the file, e.g. PHS_SERVER_REQUEST_DURATION_BUCKETS.
+// The resulting configuration is validated with the same rules the metrics
+// are registered with.
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if strings.ToLower(filepath.Ext(path)) == ".json" {
+			dec := json.NewDecoder(bytes.NewReader(data))
+			dec.DisallowUnknownFields()
+			err = dec.Decode(cfg)
+		} else {
+			err = yaml.UnmarshalStrict(data, cfg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %s: %v", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if _, err := cfg.ServerMetrics(); err != nil {
+		return nil, err
+	}
+	if _, err := cfg.ClientMetrics(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides the configuration with the environment variables
+// returned by lookup.
+func (cfg *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var err error
+	str := func(name string, v *string) {
+		if e, ok := lookup(name); ok {
+			*v = e
+		}
+	}
+	layout := func(name string, v interface{}) {
+		e, ok := lookup(name)
+		if !ok || err != nil {
+			return
+		}
+		switch v := v.(type) {
+		case **BucketConfig:
+			*v = &BucketConfig{}
+			err = (*v).UnmarshalText([]byte(e))
+		case **PercentileConfig:
+			*v = &PercentileConfig{}
+			err = (*v).UnmarshalText([]byte(e))
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	list := func(name string, v *[]string) {
+		if e, ok := lookup(name); ok {
+			*v = splitList(e)
+		}
+	}
+	labels := func(name string, v *map[string]string) {
+		if e, ok := lookup(name); ok && err == nil {
+			*v, err = parseLabels(name, e)
+		}
+	}
+	boolean := func(name string, v *bool) {
+		if e, ok := lookup(name); ok && err == nil {
+			if *v, err = strconv.ParseBool(e); err != nil {
+				err = fmt.Errorf("cannot parse %s=%q into bool", name, e)
+			}
+		}
+	}
+	float := func(name string, v *float64) {
+		if e, ok := lookup(name); ok && err == nil {
+			if *v, err = strconv.ParseFloat(e, 64); err != nil {
+				err = fmt.Errorf("cannot parse %s=%q into float", name, e)
+			}
+		}
+	}
+
+	s := &cfg.Server
+	str("PHS_SERVER_NAMESPACE", &s.Namespace)
+	str("PHS_SERVER_SUBSYSTEM", &s.Subsystem)
+	labels("PHS_SERVER_CONST_LABELS", &s.ConstLabels)
+	layout("PHS_SERVER_REQUEST_DURATION_BUCKETS", &s.RequestDurationBuckets)
+	layout("PHS_SERVER_REQUEST_DURATION_PERCENTILES", &s.RequestDurationPercentiles)
+	layout("PHS_SERVER_REQUEST_SIZE_BUCKETS", &s.RequestSizeBuckets)
+	layout("PHS_SERVER_RESPONSE_SIZE_BUCKETS", &s.ResponseSizeBuckets)
+	layout("PHS_SERVER_TIME_TO_WRITE_HEADER_BUCKETS", &s.TimeToWriteHeaderBuckets)
+	layout("PHS_SERVER_TIME_TO_FIRST_BYTE_BUCKETS", &s.TimeToFirstByteBuckets)
+	float("PHS_SERVER_NATIVE_HISTOGRAM_BUCKET_FACTOR", &s.NativeHistogramBucketFactor)
+	boolean("PHS_SERVER_INFLIGHT_AGGREGATE", &s.InflightAggregate)
+	str("PHS_SERVER_SLO_WINDOWS", &s.SLOWindows)
+	list("PHS_SERVER_DISABLE", &s.Disable)
+
+	c := &cfg.Client
+	str("PHS_CLIENT_NAMESPACE", &c.Namespace)
+	str("PHS_CLIENT_SUBSYSTEM", &c.Subsystem)
+	labels("PHS_CLIENT_CONST_LABELS", &c.ConstLabels)
+	layout("PHS_CLIENT_REQUEST_DURATION_BUCKETS", &c.RequestDurationBuckets)
+	layout("PHS_CLIENT_REQUEST_DURATION_PERCENTILES", &c.RequestDurationPercentiles)
+	layout("PHS_CLIENT_CONNECTION_BUCKETS", &c.ConnectionBuckets)
+	layout("PHS_CLIENT_TIME_TO_FIRST_BYTE_BUCKETS", &c.TimeToFirstByteBuckets)
+	float("PHS_CLIENT_NATIVE_HISTOGRAM_BUCKET_FACTOR", &c.NativeHistogramBucketFactor)
+	list("PHS_CLIENT_DISABLE", &c.Disable)
+
+	return err
+}
+
+// ServerMetrics returns the server side metrics described by the
+// configuration, starting from NewDefaultServerMetrics.
+func (cfg *Config) ServerMetrics() (*ServerMetrics, error) {
+	s := &cfg.Server
+	m := NewDefaultServerMetrics()
+	m.Namespace = s.Namespace
+	m.Subsystem = s.Subsystem
+	m.ConstLabels = s.ConstLabels
+	m.NativeHistogramBucketFactor = s.NativeHistogramBucketFactor
+	m.InflightAggregate = s.InflightAggregate
+
+	for _, c := range s.SLOs {
+		slo := SLO{
+			Handler:    c.Handler,
+			Target:     c.Target,
+			ErrorCodes: c.ErrorCodes,
+		}
+		if c.LatencyThreshold != "" {
+			d, err := parseDuration(c.LatencyThreshold)
+			if err != nil {
+				return nil, fmt.Errorf("slo latency threshold of handler %q: %v", c.Handler, err)
+			}
+			slo.LatencyThreshold = d
+		}
+		m.SLOs = append(m.SLOs, slo)
+	}
+	if s.SLOWindows != "" {
+		for _, e := range splitEntries(s.SLOWindows) {
+			d, err := parseDuration(e.token)
+			if err != nil {
+				return nil, fmt.Errorf("slo window: %v", err)
+			}
+			m.SLOWindows = append(m.SLOWindows, d)
+		}
+	}
+
+	m.ReqDurationHistConf = buckets(s.RequestDurationBuckets, m.ReqDurationHistConf)
+	m.ReqDurationPercentileConf = percentiles(s.RequestDurationPercentiles, m.ReqDurationPercentileConf)
+	m.ReqSizeBuckets = buckets(s.RequestSizeBuckets, m.ReqSizeBuckets)
+	m.RespSizeBuckets = buckets(s.ResponseSizeBuckets, m.RespSizeBuckets)
+	m.TimeToWriteHeaderBuckets = buckets(s.TimeToWriteHeaderBuckets, m.TimeToWriteHeaderBuckets)
+	m.TimeToFirstByteBuckets = buckets(s.TimeToFirstByteBuckets, m.TimeToFirstByteBuckets)
+
+	for _, f := range s.Disable {
+		switch f {
+		case FamilyRequestDuration:
+			m.ReqDurationHistConf = nil
+		case FamilyRequestDurationPercentiles:
+			m.ReqDurationPercentileConf = nil
+		case FamilyRequestSize:
+			m.ReqSizeBuckets = nil
+		case FamilyResponseSize:
+			m.RespSizeBuckets = nil
+		case FamilyTimeToWriteHeader:
+			m.TimeToWriteHeaderBuckets = nil
+		case FamilyTimeToFirstByte:
+			m.TimeToFirstByteBuckets = nil
+		default:
+			return nil, fmt.Errorf("unknown server metric family %q", f)
+		}
+	}
+
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ClientMetrics returns the client side metrics described by the
+// configuration, starting from NewDefaultClientMetrics.
+func (cfg *Config) ClientMetrics() (*ClientMetrics, error) {
+	c := &cfg.Client
+	m := NewDefaultClientMetrics()
+	m.Namespace = c.Namespace
+	m.Subsystem = c.Subsystem
+	m.ConstLabels = c.ConstLabels
+	m.NativeHistogramBucketFactor = c.NativeHistogramBucketFactor
+
+	m.ReqDurationHistConf = buckets(c.RequestDurationBuckets, m.ReqDurationHistConf)
+	m.ReqDurationPercentileConf = percentiles(c.RequestDurationPercentiles, m.ReqDurationPercentileConf)
+	m.ConnectionBuckets = buckets(c.ConnectionBuckets, m.ConnectionBuckets)
+	m.TimeToFirstByteBuckets = buckets(c.TimeToFirstByteBuckets, m.TimeToFirstByteBuckets)
+
+	for _, f := range c.Disable {
+		switch f {
+		case FamilyRequestDuration:
+			m.ReqDurationHistConf = nil
+		case FamilyRequestDurationPercentiles:
+			m.ReqDurationPercentileConf = nil
+		case FamilyConnection:
+			m.ConnectionBuckets = nil
+		case FamilyTimeToFirstByte:
+			m.TimeToFirstByteBuckets = nil
+		default:
+			return nil, fmt.Errorf("unknown client metric family %q", f)
+		}
+	}
+
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// buckets returns the layout b, or def if b is not set.
+func buckets(b *BucketConfig, def BucketConfig) BucketConfig {
+	if b == nil {
+		return def
+	}
+	return *b
+}
+
+// parseDuration parses a duration in seconds or with a time unit, like
+// 300ms or 3d. Unlike parseValue, it does not accept byte sizes.
+func parseDuration(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("cannot parse %q into duration", s)
+		}
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q into duration", s)
+	}
+	return time.Duration(d), nil
+}
+
+// percentiles returns the percentiles p, or def if p is not set.
+func percentiles(p *PercentileConfig, def PercentileConfig) PercentileConfig {
+	if p == nil {
+		return def
+	}
+	return *p
+}
+
+// splitList splits a comma separated list, dropping empty elements.
+func splitList(s string) []string {
+	l := []string{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// parseLabels parses a comma separated list of name=value pairs.
+func parseLabels(name, s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, e := range splitList(s) {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("cannot parse %q of %s into name=value", e, name)
+		}
+		labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
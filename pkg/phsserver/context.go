@@ -0,0 +1,56 @@
+package phsserver
+
+import (
+	"context"
+)
+
+type contextKey int
+
+const (
+	actionKey contextKey = iota
+	handlerKey
+	nextHandlerKey
+	endpointKey
+)
+
+// WithAction returns a copy of ctx which carries name as the action. The
+// client instrumentation uses it as value of the action label for all
+// requests made with this context.
+func WithAction(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, actionKey, name)
+}
+
+// ActionFrom returns the action stored in ctx by WithAction. If no action
+// has been set, the name of the handler wrapped by WrapHandler which is
+// serving the request is returned. Without either of them the result is the
+// empty string.
+func ActionFrom(ctx context.Context) string {
+	if a, ok := ctx.Value(actionKey).(string); ok {
+		return a
+	}
+	if h, ok := ctx.Value(handlerKey).(string); ok {
+		return h
+	}
+	return ""
+}
+
+// withHandler returns a copy of ctx which carries the name of the server
+// side handler.
+func withHandler(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, handlerKey, name)
+}
+
+// WithEndpoint returns a copy of ctx which carries id as the endpoint. The
+// client instrumentation uses it as value of the endpoint label instead of
+// the name passed to WrapTransport, so a single client can tell the
+// operations of a remote service apart.
+func WithEndpoint(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, endpointKey, id)
+}
+
+// EndpointFrom returns the endpoint stored in ctx by WithEndpoint, or the
+// empty string if there is none.
+func EndpointFrom(ctx context.Context) string {
+	e, _ := ctx.Value(endpointKey).(string)
+	return e
+}
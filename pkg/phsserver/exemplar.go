@@ -0,0 +1,47 @@
+package phsserver
+
+import (
+	"context"
+
+	"github.com/openzipkin/zipkin-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ExemplarFunc returns the labels of the exemplar attached to observations
+// made for a request with context ctx. It returns nil if there is no
+// exemplar for the request.
+type ExemplarFunc func(ctx context.Context) prometheus.Labels
+
+// ZipkinExemplar returns the trace ID of the zipkin span stored in ctx as
+// exemplar label trace_id. Spans which are not sampled are ignored, because
+// their traces cannot be looked up.
+func ZipkinExemplar(ctx context.Context) prometheus.Labels {
+	span := zipkin.SpanFromContext(ctx)
+	if span == nil {
+		return nil
+	}
+	sc := span.Context()
+	if sc.Sampled != nil && !*sc.Sampled {
+		return nil
+	}
+	return prometheus.Labels{"trace_id": sc.TraceID.String()}
+}
+
+// observe observes v on o and attaches the exemplar e, if there is one and
+// o supports exemplars.
+func observe(o prometheus.Observer, v float64, e prometheus.Labels) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && e != nil {
+		eo.ObserveWithExemplar(v, e)
+		return
+	}
+	o.Observe(v)
+}
+
+// inc increments c and attaches the exemplar e, if there is one.
+func inc(c prometheus.Counter, e prometheus.Labels) {
+	if ea, ok := c.(prometheus.ExemplarAdder); ok && e != nil {
+		ea.AddWithExemplar(1, e)
+		return
+	}
+	c.Inc()
+}
@@ -2,11 +2,13 @@ package phsserver
 
 import (
 	"fmt"
+	"math"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 //BucketConfig stores the values for buckets.
@@ -27,45 +29,94 @@ type PercentileConfig  map[float64]float64
 // which represent the upper bound of the bucket. Leading and trailing semicolons
 // are forbiddem, as well as double semicolons, which would result in an invalid
 // border. The value of the entroes, when parsed as floats, must e strict
-// monotonic growing.
+// monotonic growing, finite and not negative. Surrounding whitespace is
+// ignored. Values may have a unit suffix: ns, us, ms, s, m and h are
+// converted to seconds, B, KB, MB, GB, KiB, MiB and GiB to bytes. Errors are
+// returned as *ParseError.
+//
+// Instead of a single value, an entry may be a generator expression:
+// lin(start,width,count) and exp(start,factor,count) expand like
+// NewLinearBuckets and NewExponentialBuckets, log(min,max,perDecade) like
+// NewDecadeBuckets. slo(target,...) adds the latency targets to the
+// complete layout like NewSLOBuckets, e.g. "exp(0.001,2,12);slo(0.3)".
 func NewBucketConfig(config string) (*BucketConfig, error) {
-	sizes := strings.Split(config, ";")
 	buckets := make(BucketConfig, 0)
-	for idx, b := range sizes {
-		f, err := strconv.ParseFloat(b, 64)
+	targets := []float64{}
+	for _, e := range splitEntries(config) {
+		perr := func(format string, a ...interface{}) error {
+			return &ParseError{Pos: e.pos, Token: e.token, Reason: fmt.Sprintf(format, a...)}
+		}
+		if e.token == "" {
+			return nil, perr("empty entry")
+		}
+
+		values, t, ok, err := parseGenerator(e.token)
 		if err != nil {
-			return nil, fmt.Errorf("Cannot parse %q into float.", b)
+			return nil, perr("%v", err)
+		}
+		if !ok {
+			f, err := parseValue(e.token)
+			if err != nil {
+				return nil, perr("%v", err)
+			}
+			values = BucketConfig{f}
 		}
-		buckets = append(buckets, f)
 
-		if idx >= 1 && buckets[idx-1] > buckets[idx] {
-			return nil, fmt.Errorf("Buckets out of order, idx(%d) < idx-1",
-				idx)
+		for _, f := range append(values, t...) {
+			if err := checkBound(f); err != nil {
+				return nil, perr("%v", err)
+			}
+		}
+		for _, f := range values {
+			if n := len(buckets); n > 0 && buckets[n-1] >= f {
+				return nil, perr("bound %g not greater than previous bound %g",
+					f, buckets[n-1])
+			}
+			buckets = append(buckets, f)
 		}
+		targets = append(targets, t...)
+	}
 
+	if len(targets) > 0 {
+		buckets = NewSLOBuckets(buckets, targets...)
 	}
 	return &buckets, nil
 }
 
-// NewBuckConfig returns a new bucketconfiguration from a string representation
-// of the buckets. The string consits of a semicolon separated list of time values,
-// which represent the upper bound of the bucket. Leading and trailing semicolons
-// are forbiddem, as well as double semicolons, which would result in an invalid
-// border. The value of the entroes, when parsed as floats, must e strict
-// monotonic growing.
+// NewPercentileConfig returns a new percentile configuration from a string
+// representation. The string consists of a semicolon separated list of
+// percentiles between 0 and 100, each optionally followed by a colon and the
+// allowed error in percent, e.g. "50;90:1;99.9:0.01". Without an error, a
+// default depending on the percentile is used.
 func NewPercentileConfig(config string) (*PercentileConfig, error) {
 
 	percentiles := make(PercentileConfig)
-	sizes := strings.Split(config, ";")
 
 	var e float64
-	for _,pwitherr := range sizes {
+	for _, entry := range splitEntries(config) {
+		pwitherr := entry.token
+		perr := func(format string, a ...interface{}) error {
+			return &ParseError{Pos: entry.pos, Token: pwitherr, Reason: fmt.Sprintf(format, a...)}
+		}
+		if pwitherr == "" {
+			return nil, perr("empty entry")
+		}
 		d := strings.Split(pwitherr, ":")
+		if len(d) > 2 {
+			return nil, perr("more than one colon")
+		}
 
-		p, err := strconv.ParseFloat(d[0], 64)
+		p, err := strconv.ParseFloat(strings.TrimSpace(d[0]), 64)
 		if err != nil {
-			return nil, fmt.Errorf("Cannot parse percentile %q of %q into float", d[0], pwitherr)
+			return nil, perr("cannot parse percentile %q into float", d[0])
+		}
+		if math.IsNaN(p) || p < 0 || p > 100 {
+			return nil, perr("percentile %g out of range [0, 100]", p)
+		}
+		if _, ok := percentiles[p/100]; ok {
+			return nil, perr("duplicate percentile %g", p)
 		}
+
 		if len(d) == 1 {
 			switch {
 			case p < 90: {
@@ -81,23 +132,28 @@ func NewPercentileConfig(config string) (*PercentileConfig, error) {
 
 			percentiles[p/100] = e
 			continue
-		} else if len(d) == 2 {
-			e, err := strconv.ParseFloat(d[1], 64)
-
-			if err != nil {
-				return nil, fmt.Errorf("Cannot parse error %q of %q into float", d[1], pwitherr)
-			}
-			percentiles[p/100] = e/100
-		} else {
+		}
 
+		e, err := strconv.ParseFloat(strings.TrimSpace(d[1]), 64)
+		if err != nil {
+			return nil, perr("cannot parse error %q into float", d[1])
 		}
+		if math.IsNaN(e) || e < 0 || e > 100 {
+			return nil, perr("error %g out of range [0, 100]", e)
+		}
+		percentiles[p/100] = e/100
 	}
 	return &percentiles, nil
 }
 
 // Metics holds the prometheus metrics for server side metrics.
 type ServerMetrics struct {
-	ReqInflight        prometheus.Gauge
+	// ReqInflight is the number of requests being served, labeled with
+	// handler and method. ReqInflightAggregate is the number over all
+	// handlers, it is only registered if InflightAggregate is set.
+	ReqInflight          *prometheus.GaugeVec
+	ReqInflightAggregate prometheus.Gauge
+	InflightAggregate    bool
 	ReqCounter         *prometheus.CounterVec
 
 	ReqDurationHisto       *prometheus.HistogramVec
@@ -111,8 +167,55 @@ type ServerMetrics struct {
 
 	RespSize           *prometheus.HistogramVec
 	RespSizeBuckets    BucketConfig
+
+	// TimeToWriteHeader and TimeToFirstByte are the durations until the
+	// response header and the first byte of the body have been written.
+	// They matter for streaming and long-polling handlers, whose total
+	// duration says little. They are only registered if their buckets
+	// are configured.
+	TimeToWriteHeader        *prometheus.HistogramVec
+	TimeToWriteHeaderBuckets BucketConfig
+	TimeToFirstByte          *prometheus.HistogramVec
+	TimeToFirstByteBuckets   BucketConfig
+
+	// Admission enables load shedding in WrapHandler if it is set. Shed
+	// requests are counted in ReqShed, ReqQueued is the number of
+	// requests waiting for admission. Both are only registered with
+	// Admission.
+	Admission *AdmissionPolicy
+	ReqShed   *prometheus.CounterVec
+	ReqQueued *prometheus.GaugeVec
+
+	// SLOs are the service level objectives tracked for the handlers
+	// wrapped by WrapHandler. Their good and total event counters are meant
+	// for alerting, the burn rate gauges for each of the SLOWindows,
+	// DefaultSLOWindows if it is empty, are a per-instance debug view.
+	SLOs       []SLO
+	SLOWindows []time.Duration
+	slo        *sloCollector
+
+	// Namespace and Subsystem replace the default "http" and "server"
+	// parts of the metric names. ConstLabels are attached to every metric.
+	Namespace   string
+	Subsystem   string
+	ConstLabels prometheus.Labels
+
+	// LabelExtractors add labels computed from the request to all
+	// metrics except the in-flight gauge. They must be set before the
+	// metrics are registered.
+	LabelExtractors []*LabelExtractor
+
+	// Exemplar returns the exemplar attached to the request counter and
+	// the duration histogram. ZipkinExemplar is used if it is nil.
+	Exemplar ExemplarFunc
+	// NativeHistogramBucketFactor enables native histograms for the
+	// request duration if it is greater than one. See
+	// prometheus.HistogramOpts for its meaning.
+	NativeHistogramBucketFactor float64
 }
 
+// ClientMetrics holds the prometheus metrics for client side metrics. Use
+// WrapTransport to collect them for outgoing requests.
 type ClientMetrics struct {
 	ReqCounter *prometheus.CounterVec
 
@@ -121,6 +224,96 @@ type ClientMetrics struct {
 
 	ReqDurationPercentiles *prometheus.SummaryVec
 	ReqDurationPercentileConf PercentileConfig
+
+	// DNSDuration, ConnectDuration and TLSDuration break down the setup
+	// of new connections, Connections counts the connections used by
+	// requests, labeled with whether they were reused from the pool.
+	// They are only registered if ConnectionBuckets are configured.
+	DNSDuration       *prometheus.HistogramVec
+	ConnectDuration   *prometheus.HistogramVec
+	TLSDuration       *prometheus.HistogramVec
+	Connections       *prometheus.CounterVec
+	ConnectionBuckets BucketConfig
+
+	// Retries counts the attempts repeated by the retry layer of
+	// pkg/phsclient. The final outcome of a call is counted in
+	// ReqCounter.
+	Retries *prometheus.CounterVec
+
+	// CircuitState and CircuitTransitions export the state of the circuit
+	// breakers of pkg/phsclient. CircuitState is 1 for the current state
+	// of an endpoint and 0 for the others.
+	CircuitState       *prometheus.GaugeVec
+	CircuitTransitions *prometheus.CounterVec
+
+	// ReqInflight, ReqQueued, ReqRejected and ConcurrencyLimit export the
+	// concurrency limiters of pkg/phsclient per endpoint.
+	ReqInflight      *prometheus.GaugeVec
+	ReqQueued        *prometheus.GaugeVec
+	ReqRejected      *prometheus.CounterVec
+	ConcurrencyLimit *prometheus.GaugeVec
+
+	// TimeToFirstByte is the duration until the first byte of the
+	// response arrived. It is only registered if its buckets are
+	// configured.
+	TimeToFirstByte        *prometheus.HistogramVec
+	TimeToFirstByteBuckets BucketConfig
+
+	// Namespace and Subsystem replace the default "http" and "client"
+	// parts of the metric names. ConstLabels are attached to every metric.
+	Namespace   string
+	Subsystem   string
+	ConstLabels prometheus.Labels
+
+	// Exemplar returns the exemplar attached to the request counter and
+	// the duration histogram. ZipkinExemplar is used if it is nil.
+	Exemplar ExemplarFunc
+	// NativeHistogramBucketFactor enables native histograms for the
+	// request duration if it is greater than one. See
+	// prometheus.HistogramOpts for its meaning.
+	NativeHistogramBucketFactor float64
+}
+
+func (m *ServerMetrics) namespace() string {
+	if m.Namespace != "" {
+		return m.Namespace
+	}
+	return "http"
+}
+
+func (m *ServerMetrics) subsystem() string {
+	if m.Subsystem != "" {
+		return m.Subsystem
+	}
+	return "server"
+}
+
+func (m *ServerMetrics) exemplar() ExemplarFunc {
+	if m.Exemplar != nil {
+		return m.Exemplar
+	}
+	return ZipkinExemplar
+}
+
+func (m *ClientMetrics) namespace() string {
+	if m.Namespace != "" {
+		return m.Namespace
+	}
+	return "http"
+}
+
+func (m *ClientMetrics) subsystem() string {
+	if m.Subsystem != "" {
+		return m.Subsystem
+	}
+	return "client"
+}
+
+func (m *ClientMetrics) exemplar() ExemplarFunc {
+	if m.Exemplar != nil {
+		return m.Exemplar
+	}
+	return ZipkinExemplar
 }
 
 func NewDefaultServerMetrics() *ServerMetrics {
@@ -154,157 +347,444 @@ func NewLargeSizes() BucketConfig {
 		5 * 1024 * 1024, 10 * 1024 * 1024}
 }
 
+// ClientMetricsRegister registers the client side metrics with the default
+// Prometheus registry. It panics if the registration fails.
 func ClientMetricsRegister(m *ClientMetrics) {
+	if err := ClientMetricsRegisterWith(prometheus.DefaultRegisterer, m); err != nil {
+		panic(err)
+	}
+}
+
+// ClientMetricsRegisterWith registers the client side metrics with reg. Like
+// ServerMetricsRegisterWith, the duration buckets and percentiles are only
+// registered if they have been configured. If any of the metrics cannot be
+// registered, e.g. because they are already registered with reg, the error is
+// returned and none of the metrics stay registered. So is the error reported
+// by Validate.
+func ClientMetricsRegisterWith(reg prometheus.Registerer, m *ClientMetrics) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	cs := []prometheus.Collector{}
 
 	m.ReqCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: "http",
-			Subsystem: "client",
+			Namespace: m.namespace(),
+			Subsystem: m.subsystem(),
+			ConstLabels: m.ConstLabels,
 			Name: "requests_total",
-			Help: "http server side requests counter",
+			Help: "http client side requests counter",
 		},
 		[]string{"code", "method", "endpoint", "action"},
 	)
-	if len(m.ReqDurationHistConf) > 0 {
+	cs = append(cs, m.ReqCounter)
+
+	m.Retries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: m.namespace(),
+			Subsystem: m.subsystem(),
+			ConstLabels: m.ConstLabels,
+			Name: "retries_total",
+			Help: "http client side retried attempts",
+		},
+		[]string{"method", "endpoint", "reason"},
+	)
+	cs = append(cs, m.Retries)
+
+	m.CircuitState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: m.namespace(),
+			Subsystem: m.subsystem(),
+			ConstLabels: m.ConstLabels,
+			Name: "circuit_state",
+			Help: "http client side circuit breaker state",
+		},
+		[]string{"endpoint", "state"},
+	)
+	m.CircuitTransitions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: m.namespace(),
+			Subsystem: m.subsystem(),
+			ConstLabels: m.ConstLabels,
+			Name: "circuit_transitions_total",
+			Help: "http client side circuit breaker state transitions",
+		},
+		[]string{"endpoint", "from", "to"},
+	)
+	cs = append(cs, m.CircuitState, m.CircuitTransitions)
+
+	gauge := func(name, help string) *prometheus.GaugeVec {
+		g := prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: m.namespace(),
+				Subsystem: m.subsystem(),
+				ConstLabels: m.ConstLabels,
+				Name: name,
+				Help: help,
+			},
+			[]string{"endpoint"},
+		)
+		cs = append(cs, g)
+		return g
+	}
+	m.ReqInflight = gauge("requests_inflight",
+		"http client side requests in flight")
+	m.ReqQueued = gauge("requests_queued",
+		"http client side requests waiting for the concurrency limit")
+	m.ConcurrencyLimit = gauge("concurrency_limit",
+		"http client side concurrency limit")
+	m.ReqRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: m.namespace(),
+			Subsystem: m.subsystem(),
+			ConstLabels: m.ConstLabels,
+			Name: "requests_rejected_total",
+			Help: "http client side requests rejected by the concurrency limit",
+		},
+		[]string{"endpoint", "reason"},
+	)
+	cs = append(cs, m.ReqRejected)
+
+	if len(m.ReqDurationHistConf) > 0 || m.NativeHistogramBucketFactor > 1 {
 	m.ReqDurationHisto = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts {
-			Namespace: "http",
-			Subsystem: "client",
+			Namespace: m.namespace(),
+			Subsystem: m.subsystem(),
+			ConstLabels: m.ConstLabels,
 			Name: "requests_duration",
 			Help: "Client side http duration histogram",
 			Buckets: m.ReqDurationHistConf,
+			NativeHistogramBucketFactor: m.NativeHistogramBucketFactor,
 			},
 		[]string{"code", "method", "endpoint", "action"})
+	cs = append(cs, m.ReqDurationHisto)
 	}
 
 	if len(m.ReqDurationPercentileConf) > 0 {
 		m.ReqDurationPercentiles = prometheus.NewSummaryVec(
 			prometheus.SummaryOpts {
-				Namespace: "http",
-				Subsystem: "client",
+				Namespace: m.namespace(),
+				Subsystem: m.subsystem(),
+				ConstLabels: m.ConstLabels,
 				Name: "request_duration_percentile",
+				Help: "Client side http duration percentiles",
 				Objectives: m.ReqDurationPercentileConf,
 			},
 			[]string{"code", "method", "endpoint", "action"})
+		cs = append(cs, m.ReqDurationPercentiles)
+	}
+
+	if len(m.ConnectionBuckets) > 0 {
+		histo := func(name, help string) *prometheus.HistogramVec {
+			h := prometheus.NewHistogramVec(
+				prometheus.HistogramOpts{
+					Namespace: m.namespace(),
+					Subsystem: m.subsystem(),
+					ConstLabels: m.ConstLabels,
+					Name: name,
+					Help: help,
+					Buckets: m.ConnectionBuckets,
+				},
+				[]string{"endpoint"})
+			cs = append(cs, h)
+			return h
+		}
+		m.DNSDuration = histo("dns_duration_seconds",
+			"Client side duration of DNS lookups")
+		m.ConnectDuration = histo("connect_duration_seconds",
+			"Client side duration of establishing connections")
+		m.TLSDuration = histo("tls_duration_seconds",
+			"Client side duration of TLS handshakes")
+
+		m.Connections = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: m.namespace(),
+				Subsystem: m.subsystem(),
+				ConstLabels: m.ConstLabels,
+				Name: "connections_total",
+				Help: "Client side connections used by requests",
+			},
+			[]string{"endpoint", "reused"})
+		cs = append(cs, m.Connections)
+	}
+
+	if len(m.TimeToFirstByteBuckets) > 0 {
+		m.TimeToFirstByte = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: m.namespace(),
+				Subsystem: m.subsystem(),
+				ConstLabels: m.ConstLabels,
+				Name: "time_to_first_byte_seconds",
+				Help: "Client side time until the first response byte arrived",
+				Buckets: m.TimeToFirstByteBuckets,
+			},
+			[]string{"endpoint"})
+		cs = append(cs, m.TimeToFirstByte)
 	}
+	return registerAll(reg, cs)
 }
 
 
-// SerrverMetricsRegister registers all the metrics with Prometheus. It takes care  not
-// to register the buckets, if they have not been configured. The counters are
-// registered anyways.
+// ServerMetricsRegister registers all the metrics with the default Prometheus
+// registry. It panics if the registration fails.
 func ServerMetricsRegister(m *ServerMetrics) {
-	m.ReqInflight = prometheus.NewGauge(
+	if err := ServerMetricsRegisterWith(prometheus.DefaultRegisterer, m); err != nil {
+		panic(err)
+	}
+}
+
+// ServerMetricsRegisterWith registers all the metrics with reg. It takes care
+// not to register the buckets, if they have not been configured. The counters
+// are registered anyways. If any of the metrics cannot be registered, e.g.
+// because they are already registered with reg, the error is returned and none
+// of the metrics stay registered. So is the error reported by Validate.
+func ServerMetricsRegisterWith(reg prometheus.Registerer, m *ServerMetrics) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	cs := []prometheus.Collector{}
+
+	m.ReqInflight = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: "http",
-			Subsystem: "server",
+			Namespace: m.namespace(),
+			Subsystem: m.subsystem(),
+			ConstLabels: m.ConstLabels,
 			Name: "requests_inflight",
 			Help: "A gauge of requests currently being served",
 		},
+		[]string{"handler", "method"},
 	)
-	prometheus.MustRegister(m.ReqInflight)
+	cs = append(cs, m.ReqInflight)
+
+	if m.InflightAggregate {
+		m.ReqInflightAggregate = prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: m.namespace(),
+				Subsystem: m.subsystem(),
+				ConstLabels: m.ConstLabels,
+				Name: "requests_inflight_aggregate",
+				Help: "A gauge of requests currently being served by all handlers",
+			},
+		)
+		cs = append(cs, m.ReqInflightAggregate)
+	}
 
 	m.ReqCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: "http",
-			Subsystem: "server",
+			Namespace: m.namespace(),
+			Subsystem: m.subsystem(),
+			ConstLabels: m.ConstLabels,
 			Name: "requests_total",
 			Help: "http server side requests counter",
 		},
-		[]string{"code", "method", "handler"},
+		m.serverLabels(),
 	)
 
-	prometheus.MustRegister(m.ReqCounter)
+	cs = append(cs, m.ReqCounter)
+
+	if len(m.SLOs) > 0 {
+		m.slo = newSLOCollector(m)
+		cs = append(cs, m.slo)
+	}
+
+	if m.Admission != nil {
+		m.ReqShed = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: m.namespace(),
+				Subsystem: m.subsystem(),
+				ConstLabels: m.ConstLabels,
+				Name: "requests_shed_total",
+				Help: "http server side requests shed by the admission control",
+			},
+			[]string{"handler", "priority", "reason"},
+		)
+		m.ReqQueued = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: m.namespace(),
+				Subsystem: m.subsystem(),
+				ConstLabels: m.ConstLabels,
+				Name: "requests_queued",
+				Help: "http server side requests waiting for admission",
+			},
+			[]string{"handler"},
+		)
+		cs = append(cs, m.ReqShed, m.ReqQueued)
+	}
 
-	if len(m.ReqDurationHistConf) > 0  {
+	if len(m.ReqDurationHistConf) > 0 || m.NativeHistogramBucketFactor > 1 {
 		m.ReqDurationHisto = prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
-				Namespace: "http",
-				Subsystem: "server",
+				Namespace: m.namespace(),
+				Subsystem: m.subsystem(),
+				ConstLabels: m.ConstLabels,
 				Name:    "request_duration",
 				Help:    "server side requests latencies in seconds",
 				Buckets: m.ReqDurationHistConf,
+				NativeHistogramBucketFactor: m.NativeHistogramBucketFactor,
 			},
-			[]string{"code", "method", "handler"},
+			m.serverLabels(),
 		)
-		prometheus.MustRegister(m.ReqDurationHisto)
+		cs = append(cs, m.ReqDurationHisto)
 	}
 
 	if len(m.ReqDurationPercentileConf) > 0 {
 		m.ReqDurationPercentiles = prometheus.NewSummaryVec(
 			prometheus.SummaryOpts{
-				Namespace: "http",
-				Subsystem: "server",
+				Namespace: m.namespace(),
+				Subsystem: m.subsystem(),
+				ConstLabels: m.ConstLabels,
 				Name:    "request_duration_percentile",
 				Help:    "server side requests latencies percentiles",
 				Objectives: m.ReqDurationPercentileConf,
 			},
-			[]string{"code", "method", "handler"},
+			m.serverLabels(),
 		)
-		prometheus.MustRegister(m.ReqDurationPercentiles)
+		cs = append(cs, m.ReqDurationPercentiles)
 	}
 
 	if len(m.ReqSizeBuckets) > 0 {
 		m.ReqSize = prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
-				Namespace: "http",
-				Subsystem: "server",
+				Namespace: m.namespace(),
+				Subsystem: m.subsystem(),
+				ConstLabels: m.ConstLabels,
 				Name:    "request_size",
 				Help:    "server side request size in bytes",
 				Buckets: m.ReqSizeBuckets,
 			},
-			[]string{"code", "method", "handler"},
+			m.serverLabels(),
 		)
-		prometheus.MustRegister(m.ReqSize)
+		cs = append(cs, m.ReqSize)
 	}
 	if len(m.RespSizeBuckets) > 0 {
 		m.RespSize = prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
-				Namespace: "http",
-				Subsystem: "server",
+				Namespace: m.namespace(),
+				Subsystem: m.subsystem(),
+				ConstLabels: m.ConstLabels,
 				Name:    "response_size",
-				Help:    "server side respone size in bytes",
+				Help:    "server side response size in bytes",
 				Buckets: m.RespSizeBuckets,
 			},
-			[]string{"code", "method", "handler"},
+			m.serverLabels(),
+		)
+		cs = append(cs, m.RespSize)
+	}
+	if len(m.TimeToWriteHeaderBuckets) > 0 {
+		m.TimeToWriteHeader = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: m.namespace(),
+				Subsystem: m.subsystem(),
+				ConstLabels: m.ConstLabels,
+				Name:    "time_to_write_header_seconds",
+				Help:    "server side time until the response header is written",
+				Buckets: m.TimeToWriteHeaderBuckets,
+			},
+			m.serverLabels(),
 		)
+		cs = append(cs, m.TimeToWriteHeader)
+	}
+	if len(m.TimeToFirstByteBuckets) > 0 {
+		m.TimeToFirstByte = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: m.namespace(),
+				Subsystem: m.subsystem(),
+				ConstLabels: m.ConstLabels,
+				Name:    "time_to_first_byte_seconds",
+				Help:    "server side time until the first byte of the response body is written",
+				Buckets: m.TimeToFirstByteBuckets,
+			},
+			m.serverLabels(),
+		)
+		cs = append(cs, m.TimeToFirstByte)
+	}
+	return registerAll(reg, cs)
+}
+
+// registerAll registers all collectors with reg. If one of them fails, the
+// collectors registered so far are unregistered again.
+func registerAll(reg prometheus.Registerer, cs []prometheus.Collector) error {
+	for i, c := range cs {
+		if err := reg.Register(c); err != nil {
+			for _, r := range cs[:i] {
+				reg.Unregister(r)
+			}
+			return err
+		}
 	}
+	return nil
 }
 
-// Wrap encapsulates a http.Handler which collects prometheus metrics.
+// Wrap encapsulates a http.Handler which collects prometheus metrics. The
+// name is also stored in the request context, so that client requests made
+// by the handler are labeled with it, unless an action is set explicitly.
+// With an AdmissionPolicy in m, every handler sheds its load on its own,
+// shed requests are answered with 503 and still counted in the request
+// metrics. The in-flight gauges count admitted requests only, so queued and
+// shed requests do not show up. Critical requests are admitted above the
+// MaxInflight of the admission control and can push the gauges beyond it.
 func WrapHandler(h http.Handler, name string, m *ServerMetrics) http.Handler {
-	chain := h
+	var inner http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(withHandler(r.Context(), name)))
+	})
+	if m.ReqInflight != nil || m.ReqInflightAggregate != nil {
+		inner = m.instrumentInflight(inner, name)
+	}
+	inner = m.admit(inner, name)
+	if m.slo != nil {
+		inner = m.slo.track(inner, name)
+	}
 
-	chain = promhttp.InstrumentHandlerCounter(
-		m.ReqCounter.MustCurryWith(prometheus.Labels{"handler": name}),
-		chain)
+	if len(m.LabelExtractors) == 0 {
+		return m.instrument(inner, prometheus.Labels{"handler": name})
+	}
+	return &labeledHandler{
+		next:   inner,
+		name:   name,
+		m:      m,
+		chains: make(map[string]http.Handler),
+	}
+}
 
-	chain = promhttp.InstrumentHandlerInFlight(
-		m.ReqInflight,
-		chain)
+// instrument returns the chain of instrumenting handlers around h. The labels
+// l are curried into the metrics, leaving only code and method. Each metric
+// family is instrumented only if its collector has been registered.
+func (m *ServerMetrics) instrument(h http.Handler, l prometheus.Labels) http.Handler {
+	chain := h
+	exemplar := promhttp.WithExemplarFromContext(m.exemplar())
 
-	if m.RespSize != nil {
+	if m.ReqCounter != nil {
+		chain = promhttp.InstrumentHandlerCounter(
+			m.ReqCounter.MustCurryWith(l),
+			chain, exemplar)
+	}
 
+	if m.RespSize != nil {
 		chain = promhttp.InstrumentHandlerResponseSize(
-			m.RespSize.MustCurryWith(prometheus.Labels{"handler": name}),
+			m.RespSize.MustCurryWith(l),
 			chain)
 	}
 
 	if m.ReqSize != nil {
 		chain = promhttp.InstrumentHandlerRequestSize(
-			m.ReqSize.MustCurryWith(prometheus.Labels{"handler": name}),
+			m.ReqSize.MustCurryWith(l),
 			chain)
 	}
 
-	if len(m.ReqDurationHistConf) > 0 {
+	if m.ReqDurationHisto != nil {
 		chain = promhttp.InstrumentHandlerDuration(
-			m.ReqDurationHisto.MustCurryWith(prometheus.Labels{"handler": name}),
-			chain)
+			m.ReqDurationHisto.MustCurryWith(l),
+			chain, exemplar)
 	}
-	if len(m.RespSizeBuckets)  > 0 {
+
+	if m.ReqDurationPercentiles != nil {
 		chain = promhttp.InstrumentHandlerDuration(
-			m.ReqDurationPercentiles.MustCurryWith(prometheus.Labels{"handler": name}),
+			m.ReqDurationPercentiles.MustCurryWith(l),
 			chain)
 	}
+
+	if m.TimeToWriteHeader != nil || m.TimeToFirstByte != nil {
+		chain = m.instrumentTimings(chain, l)
+	}
 	return chain
 }
@@ -0,0 +1,129 @@
+package phsserver
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultMaxLabelValues is the number of distinct values a LabelExtractor
+// reports, if MaxValues is not set.
+const DefaultMaxLabelValues = 100
+
+// OverflowLabelValue replaces all label values beyond the MaxValues limit of
+// a LabelExtractor.
+const OverflowLabelValue = "other"
+
+// LabelExtractor adds a label to the server side metrics, whose value is
+// computed from the request. To keep the cardinality of the metrics bounded,
+// only the first MaxValues distinct values are reported as they are. All
+// others are reported as OverflowLabelValue.
+type LabelExtractor struct {
+	// Name is the name of the label. It must not be one of code, method
+	// or handler.
+	Name string
+	// Extract returns the label value for a request.
+	Extract func(*http.Request) string
+	// MaxValues is the maximum number of distinct values. If it is zero,
+	// DefaultMaxLabelValues is used.
+	MaxValues int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// NewLabelExtractor returns a LabelExtractor for the label name, which
+// reports at most maxValues distinct values returned by extract.
+func NewLabelExtractor(name string, maxValues int,
+	extract func(*http.Request) string) *LabelExtractor {
+	return &LabelExtractor{
+		Name:      name,
+		Extract:   extract,
+		MaxValues: maxValues,
+	}
+}
+
+// NewHeaderLabelExtractor returns a LabelExtractor for the label name, which
+// takes its value from the request header. Requests without the header are
+// reported with an empty value.
+func NewHeaderLabelExtractor(name string, header string, maxValues int) *LabelExtractor {
+	return NewLabelExtractor(name, maxValues, func(r *http.Request) string {
+		return r.Header.Get(header)
+	})
+}
+
+// value returns the label value for r, taking the MaxValues limit into
+// account.
+func (e *LabelExtractor) value(r *http.Request) string {
+	v := e.Extract(r)
+
+	max := e.MaxValues
+	if max <= 0 {
+		max = DefaultMaxLabelValues
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.seen == nil {
+		e.seen = make(map[string]struct{})
+	}
+	if _, ok := e.seen[v]; ok {
+		return v
+	}
+	if len(e.seen) >= max {
+		return OverflowLabelValue
+	}
+	e.seen[v] = struct{}{}
+	return v
+}
+
+// serverLabels returns the label names of the server side metrics,
+// including those of the label extractors.
+func (m *ServerMetrics) serverLabels() []string {
+	l := []string{"code", "method", "handler"}
+	for _, e := range m.LabelExtractors {
+		l = append(l, e.Name)
+	}
+	return l
+}
+
+// labeledHandler instruments a handler with the label values computed by the
+// label extractors of the metrics. For every combination of label values, an
+// instrumented handler is created once and cached. The cache is bounded by
+// the MaxValues limits of the extractors.
+type labeledHandler struct {
+	next http.Handler
+	name string
+	m    *ServerMetrics
+
+	mu     sync.RWMutex
+	chains map[string]http.Handler
+}
+
+func (h *labeledHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	values := make([]string, len(h.m.LabelExtractors))
+	for i, e := range h.m.LabelExtractors {
+		values[i] = e.value(r)
+	}
+	key := strings.Join(values, "\xff")
+
+	h.mu.RLock()
+	chain, ok := h.chains[key]
+	h.mu.RUnlock()
+
+	if !ok {
+		l := prometheus.Labels{"handler": h.name}
+		for i, e := range h.m.LabelExtractors {
+			l[e.Name] = values[i]
+		}
+		h.mu.Lock()
+		if chain, ok = h.chains[key]; !ok {
+			chain = h.m.instrument(h.next, l)
+			h.chains[key] = chain
+		}
+		h.mu.Unlock()
+	}
+	chain.ServeHTTP(w, r)
+}
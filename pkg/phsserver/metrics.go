@@ -0,0 +1,95 @@
+package phsserver
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultMaxScrapes is the number of concurrent scrapes served by the
+// metrics handler, if MaxRequestsInFlight is not set.
+const DefaultMaxScrapes = 5
+
+// DefaultScrapeTimeout is the time after which a scrape is aborted, if
+// Timeout is not set.
+const DefaultScrapeTimeout = 10 * time.Second
+
+// MetricsHandlerOpts configures the handler returned by NewMetricsHandler.
+// The zero value is a useful configuration serving the default registry.
+type MetricsHandlerOpts struct {
+	// Gatherer provides the metrics. If nil, prometheus.DefaultGatherer
+	// is used.
+	Gatherer prometheus.Gatherer
+	// Registerer receives the metrics about the scrapes themselves, like
+	// promhttp_metric_handler_requests_total. If nil, the Gatherer is used
+	// if it is a prometheus.Registerer as well, e.g. a
+	// *prometheus.Registry, and prometheus.DefaultRegisterer otherwise. Set
+	// both together for a custom Gatherer which is no Registerer, or the
+	// scrape metrics end up in a registry which is not served.
+	Registerer prometheus.Registerer
+
+	// ErrorHandling defines how errors during gathering are handled, see
+	// promhttp.HandlerErrorHandling. ErrorLog, if set, logs them.
+	ErrorHandling promhttp.HandlerErrorHandling
+	ErrorLog      promhttp.Logger
+
+	// MaxRequestsInFlight limits the number of concurrent scrapes.
+	// Further scrapes are answered with 503. If zero,
+	// DefaultMaxScrapes is used, a negative value disables the limit.
+	MaxRequestsInFlight int
+	// Timeout aborts scrapes which take longer with 503. If zero,
+	// DefaultScrapeTimeout is used, a negative value disables it.
+	Timeout time.Duration
+
+	// DisableOpenMetrics turns off the OpenMetrics format, which is
+	// required for exemplars. Prometheus text and protobuf are always
+	// offered.
+	DisableOpenMetrics bool
+	// DisableCompression turns off gzip compression of the responses.
+	DisableCompression bool
+}
+
+// NewMetricsHandler returns a http.Handler serving the metrics of
+// opts.Gatherer. The exposition format is negotiated with the scraper from
+// OpenMetrics text, Prometheus text and protobuf, and the response is gzip
+// compressed if the scraper accepts it.
+func NewMetricsHandler(opts MetricsHandlerOpts) http.Handler {
+	g := opts.Gatherer
+	if g == nil {
+		g = prometheus.DefaultGatherer
+	}
+	reg := opts.Registerer
+	if reg == nil {
+		if r, ok := g.(prometheus.Registerer); ok {
+			reg = r
+		} else {
+			reg = prometheus.DefaultRegisterer
+		}
+	}
+
+	maxScrapes := opts.MaxRequestsInFlight
+	if maxScrapes == 0 {
+		maxScrapes = DefaultMaxScrapes
+	} else if maxScrapes < 0 {
+		maxScrapes = 0
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultScrapeTimeout
+	} else if timeout < 0 {
+		timeout = 0
+	}
+
+	return promhttp.InstrumentMetricHandler(reg,
+		promhttp.HandlerFor(g, promhttp.HandlerOpts{
+			ErrorLog:            opts.ErrorLog,
+			ErrorHandling:       opts.ErrorHandling,
+			Registry:            reg,
+			DisableCompression:  opts.DisableCompression,
+			MaxRequestsInFlight: maxScrapes,
+			Timeout:             timeout,
+			EnableOpenMetrics:   !opts.DisableOpenMetrics,
+		}))
+}
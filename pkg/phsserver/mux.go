@@ -0,0 +1,80 @@
+package phsserver
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// UnmatchedRoute is the handler label of requests which cannot be attributed
+// to a named route or a path template.
+const UnmatchedRoute = "unmatched"
+
+// muxInstrumenter keeps one instrumented handler per route of a mux.Router.
+type muxInstrumenter struct {
+	m *ServerMetrics
+
+	mu       sync.RWMutex
+	handlers map[string]http.Handler
+}
+
+// MuxMiddleware returns a mux.MiddlewareFunc which instruments every route of
+// a mux.Router like WrapHandler does. The handler label is the name of the
+// route, or its path template, e.g. "/users/{id}", if the route has no name.
+// Requests which match neither are reported as UnmatchedRoute. The router
+// calls middlewares only for matched routes, so wrap its NotFoundHandler
+// with WrapHandler and UnmatchedRoute to count those requests as well.
+func MuxMiddleware(m *ServerMetrics) mux.MiddlewareFunc {
+	mi := &muxInstrumenter{
+		m:        m,
+		handlers: make(map[string]http.Handler),
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), nextHandlerKey, next)
+			mi.handler(routeName(r)).ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// handler returns the instrumented handler for the route name. The mux router
+// builds the middleware chain for every request, so the instrumented handlers
+// are cached and call the route handler passed in the request context.
+func (mi *muxInstrumenter) handler(name string) http.Handler {
+	mi.mu.RLock()
+	h, ok := mi.handlers[name]
+	mi.mu.RUnlock()
+	if ok {
+		return h
+	}
+
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	if h, ok = mi.handlers[name]; !ok {
+		h = WrapHandler(http.HandlerFunc(serveNext), name, mi.m)
+		mi.handlers[name] = h
+	}
+	return h
+}
+
+// serveNext calls the handler stored in the request context by MuxMiddleware.
+func serveNext(w http.ResponseWriter, r *http.Request) {
+	r.Context().Value(nextHandlerKey).(http.Handler).ServeHTTP(w, r)
+}
+
+// routeName returns the name of the route matched by r, or its path template.
+func routeName(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return UnmatchedRoute
+	}
+	if name := route.GetName(); name != "" {
+		return name
+	}
+	if tpl, err := route.GetPathTemplate(); err == nil && tpl != "" {
+		return tpl
+	}
+	return UnmatchedRoute
+}
@@ -0,0 +1,95 @@
+package phsserver
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ParseError is returned by NewBucketConfig and NewPercentileConfig for
+// invalid configuration strings. Use errors.As to test for it.
+type ParseError struct {
+	// Pos is the byte offset of Token in the configuration string.
+	Pos int
+	// Token is the entry of the configuration, which cannot be parsed.
+	Token string
+	// Reason describes what is wrong with Token.
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("cannot parse %q at position %d: %s", e.Token, e.Pos, e.Reason)
+}
+
+// entry is one semicolon separated entry of a configuration string.
+type entry struct {
+	pos   int
+	token string
+}
+
+// splitEntries splits config at semicolons. The entries are trimmed of
+// surrounding whitespace, their positions refer to the trimmed token.
+func splitEntries(config string) []entry {
+	entries := []entry{}
+	pos := 0
+	for _, raw := range strings.Split(config, ";") {
+		token := strings.TrimSpace(raw)
+		at := pos + len(raw) - len(strings.TrimLeftFunc(raw, unicode.IsSpace))
+		entries = append(entries, entry{pos: at, token: token})
+		pos += len(raw) + 1
+	}
+	return entries
+}
+
+// units maps the suffixes accepted by parseValue to their factors. Time
+// values are converted to seconds, sizes to bytes.
+var units = map[string]float64{
+	"ns":  1e-9,
+	"us":  1e-6,
+	"µs":  1e-6,
+	"ms":  1e-3,
+	"s":   1,
+	"m":   60,
+	"h":   3600,
+	"B":   1,
+	"KB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+}
+
+// parseValue parses a float, which may have one of the unit suffixes of
+// units, like 250ms or 4KiB.
+func parseValue(s string) (float64, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	num := strings.TrimRightFunc(s, unicode.IsLetter)
+	unit := s[len(num):]
+	factor, ok := units[unit]
+	if !ok || unit == "" {
+		return 0, fmt.Errorf("cannot parse %q into float", s)
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q into float", s)
+	}
+	return f * factor, nil
+}
+
+// checkBound reports bucket bounds, which are not finite or negative.
+func checkBound(f float64) error {
+	switch {
+	case math.IsNaN(f):
+		return fmt.Errorf("bound is NaN")
+	case math.IsInf(f, 0):
+		return fmt.Errorf("bound is infinite")
+	case f < 0:
+		return fmt.Errorf("bound is negative")
+	}
+	return nil
+}
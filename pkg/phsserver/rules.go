@@ -0,0 +1,182 @@
+package phsserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// RuleInterval is the range of the rate functions in the generated rules.
+const RuleInterval = "5m"
+
+// RuleFile is a Prometheus rules file.
+type RuleFile struct {
+	Groups []RuleGroup `yaml:"groups"`
+}
+
+// RuleGroup is a group of rules in a RuleFile.
+type RuleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule is a recording rule if Record is set, an alerting rule otherwise.
+type Rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// burnAlert is a pair of windows of the multi-window, multi-burn-rate
+// alerts from the Google SRE workbook.
+type burnAlert struct {
+	long, short time.Duration
+	factor      float64
+	for_        string
+	severity    string
+}
+
+var burnAlerts = []burnAlert{
+	{time.Hour, 5 * time.Minute, 14.4, "2m", "page"},
+	{6 * time.Hour, 30 * time.Minute, 6, "15m", "page"},
+	{24 * time.Hour, 2 * time.Hour, 3, "1h", "ticket"},
+	{72 * time.Hour, 6 * time.Hour, 1, "3h", "ticket"},
+}
+
+var rulePercentiles = []float64{0.5, 0.9, 0.99}
+
+// NewRuleFile returns the recording and alerting rules for the metrics s
+// and c, either may be nil. The metric names and the enabled families are
+// taken from the metrics, so the rules match what is registered.
+func NewRuleFile(s *ServerMetrics, c *ClientMetrics) *RuleFile {
+	f := &RuleFile{}
+	if s != nil {
+		f.Groups = append(f.Groups, s.Rules())
+	}
+	if c != nil {
+		f.Groups = append(f.Groups, c.Rules())
+	}
+	return f
+}
+
+// Marshal returns the rules as YAML.
+func (f *RuleFile) Marshal() ([]byte, error) {
+	return yaml.Marshal(f)
+}
+
+// Rules returns the rules of the server side metrics: the 50th, 90th and
+// 99th percentile of the request duration and the ratio of 5xx responses
+// per handler, the burn rates of the SLOs for each window and the alerts on
+// them. The burn rates are computed from the event counters, so they do
+// not depend on the uptime of an instance and cover all of its replicas.
+func (m *ServerMetrics) Rules() RuleGroup {
+	name := func(n string) string {
+		return prometheus.BuildFQName(m.namespace(), m.subsystem(), n)
+	}
+	g := RuleGroup{Name: name("rules")}
+
+	if len(m.ReqDurationHistConf) > 0 || m.NativeHistogramBucketFactor > 1 {
+		g.Rules = append(g.Rules, quantileRules("handler", name("request_duration"),
+			len(m.ReqDurationHistConf) > 0)...)
+	}
+	g.Rules = append(g.Rules, errorRatioRule("handler", name("requests_total"), `5..`))
+
+	if len(m.SLOs) > 0 {
+		windows := m.SLOWindows
+		if len(windows) == 0 {
+			windows = DefaultSLOWindows
+		}
+		burn := map[time.Duration]string{}
+		for _, w := range windows {
+			r := burnRateRule(w, name("slo_good_events_total"),
+				name("slo_events_total"), name("slo_objective"))
+			burn[w] = r.Record
+			g.Rules = append(g.Rules, r)
+		}
+		for _, a := range burnAlerts {
+			long, okLong := burn[a.long]
+			short, okShort := burn[a.short]
+			if !okLong || !okShort {
+				continue
+			}
+			g.Rules = append(g.Rules, Rule{
+				Alert: "ErrorBudgetBurn",
+				Expr:  fmt.Sprintf(`%s > %g and %s > %g`, long, a.factor, short, a.factor),
+				For:   a.for_,
+				Labels: map[string]string{
+					"severity":    a.severity,
+					"long_window": model.Duration(a.long).String(),
+				},
+				Annotations: map[string]string{
+					"summary": fmt.Sprintf("Handler {{ $labels.handler }} burns its error budget %gx too fast over %s and %s",
+						a.factor, model.Duration(a.long), model.Duration(a.short)),
+				},
+			})
+		}
+	}
+	return g
+}
+
+// Rules returns the rules of the client side metrics: the 50th, 90th and
+// 99th percentile of the request duration and the ratio of failed requests
+// per endpoint.
+func (m *ClientMetrics) Rules() RuleGroup {
+	name := func(n string) string {
+		return prometheus.BuildFQName(m.namespace(), m.subsystem(), n)
+	}
+	g := RuleGroup{Name: name("rules")}
+
+	if len(m.ReqDurationHistConf) > 0 || m.NativeHistogramBucketFactor > 1 {
+		g.Rules = append(g.Rules, quantileRules("endpoint", name("requests_duration"),
+			len(m.ReqDurationHistConf) > 0)...)
+	}
+	g.Rules = append(g.Rules, errorRatioRule("endpoint", name("requests_total"), `5..|error`))
+	return g
+}
+
+// quantileRules records the rulePercentiles of histogram by job and label.
+// Native histograms are used if there are no classic buckets.
+func quantileRules(label, histogram string, classic bool) []Rule {
+	rules := []Rule{}
+	for _, q := range rulePercentiles {
+		expr := fmt.Sprintf("histogram_quantile(%g, sum by (job, %s) (rate(%s[%s])))",
+			q, label, histogram, RuleInterval)
+		if classic {
+			expr = fmt.Sprintf("histogram_quantile(%g, sum by (job, %s, le) (rate(%s_bucket[%s])))",
+				q, label, histogram, RuleInterval)
+		}
+		rules = append(rules, Rule{
+			Record: fmt.Sprintf("job_%s:%s:p%g_rate%s", label, histogram, q*100, RuleInterval),
+			Expr:   expr,
+		})
+	}
+	return rules
+}
+
+// errorRatioRule records the ratio of requests whose code matches errors by
+// job and label.
+func errorRatioRule(label, counter, errors string) Rule {
+	return Rule{
+		Record: fmt.Sprintf("job_%s:%s:error_ratio_rate%s", label, counter, RuleInterval),
+		Expr: fmt.Sprintf(`sum by (job, %s) (rate(%s{code=~"%s"}[%s])) / sum by (job, %s) (rate(%s[%s]))`,
+			label, counter, errors, RuleInterval, label, counter, RuleInterval),
+	}
+}
+
+// burnRateRule records the burn rate of the SLOs over window w by job and
+// handler: the ratio of bad events divided by the error budget.
+func burnRateRule(w time.Duration, good, total, objective string) Rule {
+	window := model.Duration(w)
+	return Rule{
+		Record: fmt.Sprintf("job_handler:%s:burn_rate%s", total, window),
+		Expr: fmt.Sprintf("(1 - sum by (job, handler) (rate(%s[%s])) / sum by (job, handler) (rate(%s[%s])))"+
+			" / (1 - max by (job, handler) (%s))",
+			good, window, total, window, objective),
+	}
+}
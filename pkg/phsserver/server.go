@@ -0,0 +1,91 @@
+package phsserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// MetricsServer serves the metrics on a port of its own, separate from the
+// application. This keeps the metrics available if the application server
+// is overloaded or dead locked.
+type MetricsServer struct {
+	// Router serves the metrics at /metrics. Routes like health checks
+	// may be added before the server is started, application routes do
+	// not belong here.
+	Router *mux.Router
+
+	addr string
+	srv  *http.Server
+
+	mu sync.Mutex
+	l  net.Listener
+}
+
+// NewMetricsServer returns a MetricsServer listening on addr, which serves
+// the metrics with a handler created from opts.
+func NewMetricsServer(addr string, opts MetricsHandlerOpts) *MetricsServer {
+	r := mux.NewRouter()
+	r.Handle("/metrics", NewMetricsHandler(opts))
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Metric endpoint with wrong url %q", r.URL)
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	s := &MetricsServer{
+		Router: r,
+		addr:   addr,
+	}
+	s.srv = &http.Server{
+		Addr:    addr,
+		Handler: r,
+	}
+	return s
+}
+
+// Start starts listening and serves the requests in the background. Errors
+// to listen, e.g. because the port is in use, are returned.
+func (s *MetricsServer) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.l != nil {
+		return errors.New("metrics server already started")
+	}
+
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %v", s.addr, err)
+	}
+	s.l = l
+
+	go func() {
+		err := s.srv.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("metrics endpoint error. err = %v", err)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the server listens on, or the configured address
+// if it has not been started. It is useful with port 0.
+func (s *MetricsServer) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.l != nil {
+		return s.l.Addr().String()
+	}
+	return s.addr
+}
+
+// Shutdown stops the server gracefully, waiting for active scrapes until ctx
+// is done. See http.Server.Shutdown.
+func (s *MetricsServer) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
@@ -0,0 +1,257 @@
+package phsserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// DefaultSLOWindows are the burn rate windows of the multi-window,
+// multi-burn-rate alerts from the Google SRE workbook.
+var DefaultSLOWindows = []time.Duration{
+	5 * time.Minute, 30 * time.Minute, time.Hour, 2 * time.Hour,
+	6 * time.Hour, 24 * time.Hour, 72 * time.Hour,
+}
+
+// sloMinResolution is the shortest slot of the burn rate windows.
+const sloMinResolution = time.Second
+
+// SLO is the service level objective of a handler. A request is a good
+// event if its status code is not an error and, with a LatencyThreshold,
+// it has been served within the threshold.
+type SLO struct {
+	// Handler is the name passed to WrapHandler.
+	Handler string
+
+	// Target is the objective for the ratio of good events, e.g. 0.999.
+	Target float64
+
+	// LatencyThreshold is the maximum duration of a good request. 0 tracks
+	// availability only.
+	LatencyThreshold time.Duration
+
+	// ErrorCodes are the status codes which are errors, either single
+	// codes like "429" or classes like "5xx". All 5xx codes are errors if
+	// it is empty.
+	ErrorCodes []string
+}
+
+// isError returns whether the status code is an error for s.
+func (s *SLO) isError(code int) bool {
+	if len(s.ErrorCodes) == 0 {
+		return code >= 500
+	}
+	c := strconv.Itoa(code)
+	for _, e := range s.ErrorCodes {
+		if e == c || (len(e) == 3 && strings.HasSuffix(e, "xx") && e[0] == c[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the definition of s.
+func (s *SLO) validate() error {
+	if s.Handler == "" {
+		return fmt.Errorf("slo without handler")
+	}
+	if !(s.Target > 0 && s.Target < 1) {
+		return fmt.Errorf("slo target %g of handler %q not in (0, 1)", s.Target, s.Handler)
+	}
+	if s.LatencyThreshold < 0 {
+		return fmt.Errorf("negative slo latency threshold of handler %q", s.Handler)
+	}
+	for _, e := range s.ErrorCodes {
+		if len(e) != 3 || !strings.ContainsAny(e[:1], "12345") ||
+			(e[1:] != "xx" && strings.Trim(e[1:], "0123456789") != "") {
+			return fmt.Errorf("invalid slo error code %q of handler %q", e, s.Handler)
+		}
+	}
+	return nil
+}
+
+// sloTracker counts the events of one SLO in a ring of time slots covering
+// the longest window.
+type sloTracker struct {
+	slo SLO
+
+	mu          sync.Mutex
+	good, total uint64
+	slotGood    []uint64
+	slotTotal   []uint64
+	// last is the number of the latest slot, counted since the epoch.
+	last int64
+}
+
+// sloCollector tracks the SLOs of the server metrics and exports their
+// event counters and burn rates when collected. The burn rates only cover
+// this instance since its start, alerts use rate() over the counters, see
+// ServerMetrics.Rules.
+type sloCollector struct {
+	trackers   map[string]*sloTracker
+	windows    []time.Duration
+	resolution time.Duration
+	now        func() time.Time
+
+	goodDesc, totalDesc, objectiveDesc, burnDesc *prometheus.Desc
+}
+
+// newSLOCollector returns the collector for the SLOs of m. The slots are a
+// tenth of the shortest window, but at least one second.
+func newSLOCollector(m *ServerMetrics) *sloCollector {
+	windows := m.SLOWindows
+	if len(windows) == 0 {
+		windows = DefaultSLOWindows
+	}
+	shortest, longest := windows[0], windows[0]
+	for _, w := range windows {
+		if w < shortest {
+			shortest = w
+		}
+		if w > longest {
+			longest = w
+		}
+	}
+	resolution := shortest / 10
+	if resolution < sloMinResolution {
+		resolution = sloMinResolution
+	}
+
+	c := &sloCollector{
+		trackers:   make(map[string]*sloTracker),
+		windows:    windows,
+		resolution: resolution,
+		now:        time.Now,
+	}
+	n := int(longest/resolution) + 1
+	for _, s := range m.SLOs {
+		c.trackers[s.Handler] = &sloTracker{
+			slo:       s,
+			slotGood:  make([]uint64, n),
+			slotTotal: make([]uint64, n),
+		}
+	}
+
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(m.namespace(), m.subsystem(), name),
+			help, labels, m.ConstLabels)
+	}
+	c.goodDesc = desc("slo_good_events_total",
+		"Requests meeting the service level objective", "handler")
+	c.totalDesc = desc("slo_events_total",
+		"Requests counted for the service level objective", "handler")
+	c.objectiveDesc = desc("slo_objective",
+		"Target ratio of good events of the service level objective", "handler")
+	c.burnDesc = desc("slo_burn_rate",
+		"Rate at which this instance spent the error budget since its start, for debugging only",
+		"handler", "window")
+	return c
+}
+
+// advance moves the ring of t to slot, clearing the slots in between.
+// t.mu must be held.
+func (t *sloTracker) advance(slot int64) {
+	n := int64(len(t.slotTotal))
+	if slot <= t.last {
+		return
+	}
+	from := t.last + 1
+	if slot-from >= n {
+		from = slot - n + 1
+	}
+	for s := from; s <= slot; s++ {
+		t.slotGood[s%n] = 0
+		t.slotTotal[s%n] = 0
+	}
+	t.last = slot
+}
+
+func (c *sloCollector) slot(now time.Time) int64 {
+	return now.UnixNano() / int64(c.resolution)
+}
+
+// record counts a request to handler.
+func (c *sloCollector) record(handler string, code int, d time.Duration) {
+	t, ok := c.trackers[handler]
+	if !ok {
+		return
+	}
+	good := !t.slo.isError(code) &&
+		(t.slo.LatencyThreshold == 0 || d <= t.slo.LatencyThreshold)
+
+	slot := c.slot(c.now())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(slot)
+	i := slot % int64(len(t.slotTotal))
+	t.total++
+	t.slotTotal[i]++
+	if good {
+		t.good++
+		t.slotGood[i]++
+	}
+}
+
+// track wraps next so its requests are counted for the SLO of handler.
+func (c *sloCollector) track(next http.Handler, handler string) http.Handler {
+	if _, ok := c.trackers[handler]; !ok {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := NewResponseWriter(w)
+		next.ServeHTTP(rw, r)
+		code := rw.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		c.record(handler, code, time.Since(start))
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (c *sloCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.goodDesc
+	ch <- c.totalDesc
+	ch <- c.objectiveDesc
+	ch <- c.burnDesc
+}
+
+// Collect implements prometheus.Collector. The burn rate of a window is
+// its error ratio divided by the error budget 1 - Target.
+func (c *sloCollector) Collect(ch chan<- prometheus.Metric) {
+	slot := c.slot(c.now())
+	for handler, t := range c.trackers {
+		t.mu.Lock()
+		t.advance(slot)
+		ch <- prometheus.MustNewConstMetric(c.goodDesc,
+			prometheus.CounterValue, float64(t.good), handler)
+		ch <- prometheus.MustNewConstMetric(c.totalDesc,
+			prometheus.CounterValue, float64(t.total), handler)
+		ch <- prometheus.MustNewConstMetric(c.objectiveDesc,
+			prometheus.GaugeValue, t.slo.Target, handler)
+
+		n := int64(len(t.slotTotal))
+		for _, w := range c.windows {
+			var good, total uint64
+			for s := slot - int64(w/c.resolution) + 1; s <= slot; s++ {
+				good += t.slotGood[s%n]
+				total += t.slotTotal[s%n]
+			}
+			burn := 0.0
+			if total > 0 {
+				burn = (1 - float64(good)/float64(total)) / (1 - t.slo.Target)
+			}
+			ch <- prometheus.MustNewConstMetric(c.burnDesc,
+				prometheus.GaugeValue, burn, handler, model.Duration(w).String())
+		}
+		t.mu.Unlock()
+	}
+}
@@ -0,0 +1,85 @@
+package phsserver
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// String returns the canonical form of the buckets, which NewBucketConfig
+// parses back into the same buckets, e.g. "0.1;0.5;1".
+func (b BucketConfig) String() string {
+	s := make([]string, len(b))
+	for i, v := range b {
+		s[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strings.Join(s, ";")
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (b BucketConfig) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It accepts everything
+// NewBucketConfig does. An empty text results in no buckets.
+func (b *BucketConfig) UnmarshalText(text []byte) error {
+	if strings.TrimSpace(string(text)) == "" {
+		*b = nil
+		return nil
+	}
+	c, err := NewBucketConfig(string(text))
+	if err != nil {
+		return err
+	}
+	*b = *c
+	return nil
+}
+
+// Set implements flag.Value.
+func (b *BucketConfig) Set(s string) error {
+	return b.UnmarshalText([]byte(s))
+}
+
+// String returns the canonical form of the percentiles, which
+// NewPercentileConfig parses back into the same percentiles. The percentiles
+// are sorted and each has its error, e.g. "50:5;90:1;99:0.1".
+func (p PercentileConfig) String() string {
+	keys := make([]float64, 0, len(p))
+	for k := range p {
+		keys = append(keys, k)
+	}
+	sort.Float64s(keys)
+
+	s := make([]string, len(keys))
+	for i, k := range keys {
+		s[i] = strconv.FormatFloat(roundSig(k*100, 12), 'f', -1, 64) + ":" +
+			strconv.FormatFloat(roundSig(p[k]*100, 12), 'f', -1, 64)
+	}
+	return strings.Join(s, ";")
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (p PercentileConfig) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It accepts everything
+// NewPercentileConfig does. An empty text results in no percentiles.
+func (p *PercentileConfig) UnmarshalText(text []byte) error {
+	if strings.TrimSpace(string(text)) == "" {
+		*p = nil
+		return nil
+	}
+	c, err := NewPercentileConfig(string(text))
+	if err != nil {
+		return err
+	}
+	*p = *c
+	return nil
+}
+
+// Set implements flag.Value.
+func (p *PercentileConfig) Set(s string) error {
+	return p.UnmarshalText([]byte(s))
+}
@@ -0,0 +1,95 @@
+package phsserver
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// instrumentTimings returns a handler observing the time to write the header
+// and the time to the first body byte of the responses of next. Responses
+// without a body are not observed in the time to first byte histogram.
+func (m *ServerMetrics) instrumentTimings(next http.Handler, l prometheus.Labels) http.Handler {
+	var toHeader, toFirstByte prometheus.ObserverVec
+	if m.TimeToWriteHeader != nil {
+		toHeader = m.TimeToWriteHeader.MustCurryWith(l)
+	}
+	if m.TimeToFirstByte != nil {
+		toFirstByte = m.TimeToFirstByte.MustCurryWith(l)
+	}
+	exemplar := m.exemplar()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := NewResponseWriter(w)
+		next.ServeHTTP(rw, r)
+
+		status := rw.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		rl := prometheus.Labels{
+			"code":   strconv.Itoa(status),
+			"method": SanitizeMethod(r.Method),
+		}
+		e := exemplar(r.Context())
+
+		if d := rw.TimeToWriteHeader(); toHeader != nil && d > 0 {
+			observe(toHeader.With(rl), d.Seconds(), e)
+		}
+		if d := rw.TimeToFirstByte(); toFirstByte != nil && d > 0 {
+			observe(toFirstByte.With(rl), d.Seconds(), e)
+		}
+	})
+}
+
+// instrumentInflight tracks the requests being served by next in the
+// in-flight gauges. WrapHandler puts it inside the admission control, so
+// queued and shed requests are not counted.
+func (m *ServerMetrics) instrumentInflight(next http.Handler, handler string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.ReqInflight != nil {
+			g := m.ReqInflight.With(prometheus.Labels{
+				"handler": handler,
+				"method":  SanitizeMethod(r.Method),
+			})
+			g.Inc()
+			defer g.Dec()
+		}
+		if m.ReqInflightAggregate != nil {
+			m.ReqInflightAggregate.Inc()
+			defer m.ReqInflightAggregate.Dec()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SanitizeMethod returns the method label for the http method m. Like
+// promhttp, only well known methods are reported, all others as "unknown",
+// to keep the cardinality bounded. Layers stacked on WrapTransport use it, so
+// their labels match the request metrics.
+func SanitizeMethod(m string) string {
+	switch m {
+	case "GET", "get":
+		return "get"
+	case "PUT", "put":
+		return "put"
+	case "HEAD", "head":
+		return "head"
+	case "POST", "post":
+		return "post"
+	case "DELETE", "delete":
+		return "delete"
+	case "CONNECT", "connect":
+		return "connect"
+	case "OPTIONS", "options":
+		return "options"
+	case "NOTIFY", "notify":
+		return "notify"
+	case "TRACE", "trace":
+		return "trace"
+	case "PATCH", "patch":
+		return "patch"
+	}
+	return "unknown"
+}
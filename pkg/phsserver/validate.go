@@ -0,0 +1,148 @@
+package phsserver
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// Validate reports inconsistent configuration of the server side metrics.
+// ServerMetricsRegisterWith calls it, so configuration errors are found when
+// the metrics are registered, not while serving a request.
+func (m *ServerMetrics) Validate() error {
+	if err := validateName(m.namespace(), m.subsystem()); err != nil {
+		return err
+	}
+	if err := validateBuckets("request duration", m.ReqDurationHistConf); err != nil {
+		return err
+	}
+	if err := validatePercentiles(m.ReqDurationPercentileConf); err != nil {
+		return err
+	}
+	if err := validateBuckets("request size", m.ReqSizeBuckets); err != nil {
+		return err
+	}
+	if err := validateBuckets("response size", m.RespSizeBuckets); err != nil {
+		return err
+	}
+	if err := validateBuckets("time to write header", m.TimeToWriteHeaderBuckets); err != nil {
+		return err
+	}
+	if err := validateBuckets("time to first byte", m.TimeToFirstByteBuckets); err != nil {
+		return err
+	}
+	if err := validateNativeFactor(m.NativeHistogramBucketFactor); err != nil {
+		return err
+	}
+
+	if a := m.Admission; a != nil {
+		if a.MaxInflight < 1 {
+			return fmt.Errorf("admission max inflight %d must be at least 1", a.MaxInflight)
+		}
+		if a.MaxQueue < 0 || a.QueueTimeout < 0 || a.RetryAfter < 0 {
+			return fmt.Errorf("negative admission queue or timeout")
+		}
+	}
+
+	slos := map[string]bool{}
+	for _, slo := range m.SLOs {
+		if err := slo.validate(); err != nil {
+			return err
+		}
+		if slos[slo.Handler] {
+			return fmt.Errorf("duplicate slo of handler %q", slo.Handler)
+		}
+		slos[slo.Handler] = true
+	}
+	windows := map[string]bool{}
+	for _, w := range m.SLOWindows {
+		if w < sloMinResolution {
+			return fmt.Errorf("slo window %v shorter than the resolution of %v", w, sloMinResolution)
+		}
+		label := model.Duration(w).String()
+		if windows[label] {
+			return fmt.Errorf("duplicate slo window %s", label)
+		}
+		windows[label] = true
+	}
+
+	names := map[string]bool{"code": true, "method": true, "handler": true}
+	for _, e := range m.LabelExtractors {
+		if !model.LabelName(e.Name).IsValid() {
+			return fmt.Errorf("invalid label name %q", e.Name)
+		}
+		if names[e.Name] {
+			return fmt.Errorf("duplicate label name %q", e.Name)
+		}
+		names[e.Name] = true
+		if _, ok := m.ConstLabels[e.Name]; ok {
+			return fmt.Errorf("label %q is also a const label", e.Name)
+		}
+		if e.Extract == nil {
+			return fmt.Errorf("label extractor %q without Extract function", e.Name)
+		}
+	}
+	return nil
+}
+
+// Validate reports inconsistent configuration of the client side metrics.
+// ClientMetricsRegisterWith calls it before registering the metrics.
+func (m *ClientMetrics) Validate() error {
+	if err := validateName(m.namespace(), m.subsystem()); err != nil {
+		return err
+	}
+	if err := validateBuckets("request duration", m.ReqDurationHistConf); err != nil {
+		return err
+	}
+	if err := validatePercentiles(m.ReqDurationPercentileConf); err != nil {
+		return err
+	}
+	if err := validateBuckets("connection", m.ConnectionBuckets); err != nil {
+		return err
+	}
+	if err := validateBuckets("time to first byte", m.TimeToFirstByteBuckets); err != nil {
+		return err
+	}
+	return validateNativeFactor(m.NativeHistogramBucketFactor)
+}
+
+func validateName(namespace, subsystem string) error {
+	name := prometheus.BuildFQName(namespace, subsystem, "requests_total")
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return fmt.Errorf("invalid namespace %q or subsystem %q", namespace, subsystem)
+	}
+	return nil
+}
+
+func validateBuckets(name string, b BucketConfig) error {
+	for idx, v := range b {
+		if err := checkBound(v); err != nil {
+			return fmt.Errorf("%s bucket %d: %v", name, idx, err)
+		}
+		if idx >= 1 && b[idx-1] >= v {
+			return fmt.Errorf("%s buckets out of order, idx(%d) <= idx-1", name, idx)
+		}
+	}
+	return nil
+}
+
+func validatePercentiles(p PercentileConfig) error {
+	for q, e := range p {
+		if math.IsNaN(q) || q < 0 || q > 1 {
+			return fmt.Errorf("percentile objective %g out of range [0, 1]", q)
+		}
+		if math.IsNaN(e) || e < 0 || e > 1 {
+			return fmt.Errorf("error %g of percentile objective %g out of range [0, 1]", e, q)
+		}
+	}
+	return nil
+}
+
+func validateNativeFactor(f float64) error {
+	if f != 0 && f <= 1 {
+		return fmt.Errorf("native histogram bucket factor %g must be greater than 1", f)
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+package phsserver
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ResponseWriter is a http.ResponseWriter which records the status, the
+// number of bytes written and the timing of the response. The value returned
+// by NewResponseWriter implements the same optional interfaces out of
+// http.Flusher, http.Hijacker, http.Pusher, io.ReaderFrom and
+// http.CloseNotifier as the wrapped writer, so handlers can still stream,
+// upgrade connections and use sendfile.
+type ResponseWriter interface {
+	http.ResponseWriter
+
+	// Status returns the status code of the response, or 0 if the header
+	// has not been written yet.
+	Status() int
+	// Written returns the number of body bytes written.
+	Written() int64
+	// TimeToWriteHeader returns the time from the creation of the writer
+	// until the header was written, or 0 if it has not been written yet.
+	TimeToWriteHeader() time.Duration
+	// TimeToFirstByte returns the time from the creation of the writer
+	// until the first body byte was written, or 0 if there was none yet.
+	TimeToFirstByte() time.Duration
+	// Unwrap returns the wrapped writer, as used by
+	// http.ResponseController.
+	Unwrap() http.ResponseWriter
+}
+
+// responseWriter records the response written through it.
+type responseWriter struct {
+	http.ResponseWriter
+
+	start       time.Time
+	status      int
+	written     int64
+	wroteHeader bool
+	toHeader    time.Duration
+	toFirstByte time.Duration
+}
+
+func (w *responseWriter) Status() int {
+	return w.status
+}
+
+func (w *responseWriter) Written() int64 {
+	return w.written
+}
+
+func (w *responseWriter) TimeToWriteHeader() time.Duration {
+	return w.toHeader
+}
+
+func (w *responseWriter) TimeToFirstByte() time.Duration {
+	return w.toFirstByte
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// WriteHeader records the first final status code. Informational 1xx codes
+// are passed on, but not recorded.
+func (w *responseWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= 200 {
+		w.status = code
+		w.wroteHeader = true
+		w.toHeader = time.Since(w.start)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.wrote(int64(n))
+	return n, err
+}
+
+// wrote records n body bytes written.
+func (w *responseWriter) wrote(n int64) {
+	if n > 0 && w.written == 0 {
+		w.toFirstByte = time.Since(w.start)
+	}
+	w.written += n
+}
+
+type closeNotifierDelegator struct{ *responseWriter }
+type flusherDelegator struct{ *responseWriter }
+type hijackerDelegator struct{ *responseWriter }
+type readerFromDelegator struct{ *responseWriter }
+type pusherDelegator struct{ *responseWriter }
+
+func (d closeNotifierDelegator) CloseNotify() <-chan bool {
+	return d.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+func (d flusherDelegator) Flush() {
+	if !d.wroteHeader {
+		d.WriteHeader(http.StatusOK)
+	}
+	d.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (d hijackerDelegator) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return d.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (d readerFromDelegator) ReadFrom(r io.Reader) (int64, error) {
+	if !d.wroteHeader {
+		d.WriteHeader(http.StatusOK)
+	}
+	n, err := d.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+	d.wrote(n)
+	return n, err
+}
+
+func (d pusherDelegator) Push(target string, opts *http.PushOptions) error {
+	return d.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+const (
+	closeNotifier = 1 << iota
+	flusher
+	hijacker
+	readerFrom
+	pusher
+)
+
+// pickWriter returns a ResponseWriter for each combination of the optional
+// interfaces, indexed by the bits above.
+var pickWriter = [32]func(*responseWriter) ResponseWriter{
+	func(w *responseWriter) ResponseWriter { // 0
+		return w
+	},
+	func(w *responseWriter) ResponseWriter { // 1
+		return closeNotifierDelegator{w}
+	},
+	func(w *responseWriter) ResponseWriter { // 2
+		return flusherDelegator{w}
+	},
+	func(w *responseWriter) ResponseWriter { // 3
+		return struct {
+			*responseWriter
+			http.CloseNotifier
+			http.Flusher
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 4
+		return hijackerDelegator{w}
+	},
+	func(w *responseWriter) ResponseWriter { // 5
+		return struct {
+			*responseWriter
+			http.CloseNotifier
+			http.Hijacker
+		}{w, closeNotifierDelegator{w}, hijackerDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 6
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+		}{w, flusherDelegator{w}, hijackerDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 7
+		return struct {
+			*responseWriter
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}, hijackerDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 8
+		return readerFromDelegator{w}
+	},
+	func(w *responseWriter) ResponseWriter { // 9
+		return struct {
+			*responseWriter
+			http.CloseNotifier
+			io.ReaderFrom
+		}{w, closeNotifierDelegator{w}, readerFromDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 10
+		return struct {
+			*responseWriter
+			http.Flusher
+			io.ReaderFrom
+		}{w, flusherDelegator{w}, readerFromDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 11
+		return struct {
+			*responseWriter
+			http.CloseNotifier
+			http.Flusher
+			io.ReaderFrom
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}, readerFromDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 12
+		return struct {
+			*responseWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{w, hijackerDelegator{w}, readerFromDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 13
+		return struct {
+			*responseWriter
+			http.CloseNotifier
+			http.Hijacker
+			io.ReaderFrom
+		}{w, closeNotifierDelegator{w}, hijackerDelegator{w}, readerFromDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 14
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{w, flusherDelegator{w}, hijackerDelegator{w}, readerFromDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 15
+		return struct {
+			*responseWriter
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}, hijackerDelegator{w}, readerFromDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 16
+		return pusherDelegator{w}
+	},
+	func(w *responseWriter) ResponseWriter { // 17
+		return struct {
+			*responseWriter
+			http.CloseNotifier
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, pusherDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 18
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Pusher
+		}{w, flusherDelegator{w}, pusherDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 19
+		return struct {
+			*responseWriter
+			http.CloseNotifier
+			http.Flusher
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}, pusherDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 20
+		return struct {
+			*responseWriter
+			http.Hijacker
+			http.Pusher
+		}{w, hijackerDelegator{w}, pusherDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 21
+		return struct {
+			*responseWriter
+			http.CloseNotifier
+			http.Hijacker
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, hijackerDelegator{w}, pusherDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 22
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, flusherDelegator{w}, hijackerDelegator{w}, pusherDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 23
+		return struct {
+			*responseWriter
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}, hijackerDelegator{w}, pusherDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 24
+		return struct {
+			*responseWriter
+			io.ReaderFrom
+			http.Pusher
+		}{w, readerFromDelegator{w}, pusherDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 25
+		return struct {
+			*responseWriter
+			http.CloseNotifier
+			io.ReaderFrom
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, readerFromDelegator{w}, pusherDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 26
+		return struct {
+			*responseWriter
+			http.Flusher
+			io.ReaderFrom
+			http.Pusher
+		}{w, flusherDelegator{w}, readerFromDelegator{w}, pusherDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 27
+		return struct {
+			*responseWriter
+			http.CloseNotifier
+			http.Flusher
+			io.ReaderFrom
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}, readerFromDelegator{w}, pusherDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 28
+		return struct {
+			*responseWriter
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, hijackerDelegator{w}, readerFromDelegator{w}, pusherDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 29
+		return struct {
+			*responseWriter
+			http.CloseNotifier
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, hijackerDelegator{w}, readerFromDelegator{w}, pusherDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 30
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, flusherDelegator{w}, hijackerDelegator{w}, readerFromDelegator{w}, pusherDelegator{w}}
+	},
+	func(w *responseWriter) ResponseWriter { // 31
+		return struct {
+			*responseWriter
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}, hijackerDelegator{w}, readerFromDelegator{w}, pusherDelegator{w}}
+	},
+}
+
+// NewResponseWriter returns a ResponseWriter recording the response written
+// to w. The timings are measured from the call of NewResponseWriter. If w
+// already is a ResponseWriter, it is returned unchanged.
+func NewResponseWriter(w http.ResponseWriter) ResponseWriter {
+	if rw, ok := w.(ResponseWriter); ok {
+		return rw
+	}
+	d := &responseWriter{
+		ResponseWriter: w,
+		start:          time.Now(),
+	}
+
+	id := 0
+	if _, ok := w.(http.CloseNotifier); ok {
+		id |= closeNotifier
+	}
+	if _, ok := w.(http.Flusher); ok {
+		id |= flusher
+	}
+	if _, ok := w.(http.Hijacker); ok {
+		id |= hijacker
+	}
+	if _, ok := w.(io.ReaderFrom); ok {
+		id |= readerFrom
+	}
+	if _, ok := w.(http.Pusher); ok {
+		id |= pusher
+	}
+	return pickWriter[id](d)
+}
@@ -0,0 +1,170 @@
+package _test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.bofh.at/mla/phs/pkg/phsserver"
+	"github.com/openzipkin/zipkin-go"
+	"github.com/openzipkin/zipkin-go/reporter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+			io.WriteString(w, "short and stout")
+		}))
+	defer srv.Close()
+
+	m := phsserver.NewDefaultClientMetrics()
+	err := phsserver.ClientMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	c := &http.Client{
+		Transport: phsserver.WrapTransport(nil, "teapot", m),
+	}
+	resp, err := c.Get(srv.URL)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+
+	l := prometheus.Labels{
+		"code":     "418",
+		"method":   "get",
+		"endpoint": "teapot",
+		"action":   "unknown",
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.ReqCounter.With(l)), "counter value")
+
+	ctx := phsserver.WithAction(context.Background(), "brew")
+	assert.Equal(t, "brew", phsserver.ActionFrom(ctx))
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	assert.Equal(t, nil, err)
+	resp, err = c.Do(req.WithContext(ctx))
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+
+	l["action"] = "brew"
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.ReqCounter.With(l)), "counter value with action")
+}
+
+func TestClientActionFromHandler(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "OK")
+		}))
+	defer srv.Close()
+
+	cm := phsserver.NewDefaultClientMetrics()
+	err := phsserver.ClientMetricsRegisterWith(prometheus.NewRegistry(), cm)
+	assert.Equal(t, nil, err)
+	sm := phsserver.NewDefaultServerMetrics()
+	err = phsserver.ServerMetricsRegisterWith(prometheus.NewRegistry(), sm)
+	assert.Equal(t, nil, err)
+
+	c := &http.Client{
+		Transport: phsserver.WrapTransport(nil, "backend", cm),
+	}
+	h := phsserver.WrapHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			req, err := http.NewRequestWithContext(r.Context(), "GET", srv.URL, nil)
+			assert.Equal(t, nil, err)
+			resp, err := c.Do(req)
+			assert.Equal(t, nil, err)
+			resp.Body.Close()
+		}), "checkout", sm)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(cm.ReqCounter.With(prometheus.Labels{
+		"code":     "200",
+		"method":   "get",
+		"endpoint": "backend",
+		"action":   "checkout",
+	})), "action from the handler name")
+}
+
+func TestClientExemplar(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "OK")
+		}))
+	defer srv.Close()
+
+	tracer, err := zipkin.NewTracer(reporter.NewNoopReporter())
+	assert.Equal(t, nil, err)
+	span := tracer.StartSpan("test")
+	defer span.Finish()
+	ctx := zipkin.NewContext(context.Background(), span)
+
+	traceID := span.Context().TraceID.String()
+	assert.Equal(t, prometheus.Labels{"trace_id": traceID}, phsserver.ZipkinExemplar(ctx))
+
+	reg := prometheus.NewRegistry()
+	m := phsserver.NewDefaultClientMetrics()
+	err = phsserver.ClientMetricsRegisterWith(reg, m)
+	assert.Equal(t, nil, err)
+
+	c := &http.Client{
+		Transport: phsserver.WrapTransport(nil, "ok", m),
+	}
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	assert.Equal(t, nil, err)
+	resp, err := c.Do(req.WithContext(ctx))
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+
+	mfs, err := reg.Gather()
+	assert.Equal(t, nil, err)
+	found := false
+	for _, mf := range mfs {
+		if mf.GetName() != "http_client_requests_duration" {
+			continue
+		}
+		for _, b := range mf.GetMetric()[0].GetHistogram().GetBucket() {
+			if e := b.GetExemplar(); e != nil {
+				found = true
+				assert.Equal(t, traceID, e.GetLabel()[0].GetValue())
+			}
+		}
+	}
+	assert.True(t, found, "exemplar with trace id")
+}
+
+func TestClientConnectionMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "OK")
+		}))
+	defer srv.Close()
+
+	m := phsserver.NewDefaultClientMetrics()
+	m.ConnectionBuckets = phsserver.BucketConfig{0.001, 0.01, 0.1}
+	m.TimeToFirstByteBuckets = phsserver.BucketConfig{0.01, 0.1, 1}
+	err := phsserver.ClientMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	c := &http.Client{
+		Transport: phsserver.WrapTransport(&http.Transport{}, "ok", m),
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := c.Get(srv.URL)
+		assert.Equal(t, nil, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.Connections.With(
+		prometheus.Labels{"endpoint": "ok", "reused": "false"})), "new connections")
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.Connections.With(
+		prometheus.Labels{"endpoint": "ok", "reused": "true"})), "reused connections")
+	assert.Equal(t, 1, testutil.CollectAndCount(m.ConnectDuration), "connect duration")
+	assert.Equal(t, 0, testutil.CollectAndCount(m.TLSDuration), "tls duration")
+	assert.Equal(t, 1, testutil.CollectAndCount(m.TimeToFirstByte), "time to first byte")
+}
@@ -0,0 +1,131 @@
+package _test
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.bofh.at/mla/phs/pkg/phsserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "phs")
+	assert.Equal(t, nil, err)
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	assert.Equal(t, nil, err)
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, "phs.yaml", `
+server:
+  namespace: team_shop_http
+  const_labels:
+    service: shop
+  request_duration_buckets: "0.1;0.5;1"
+  request_size_buckets: ""
+  disable: [response_size]
+  slos:
+    - handler: expensive
+      target: 0.99
+      latency_threshold: 300ms
+      error_codes: [5xx, "429"]
+  slo_windows: "5m;1h"
+client:
+  request_duration_percentiles: "50;99"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	os.Setenv("PHS_SERVER_REQUEST_DURATION_PERCENTILES", "90")
+	defer os.Unsetenv("PHS_SERVER_REQUEST_DURATION_PERCENTILES")
+
+	cfg, err := phsserver.LoadConfig(path)
+	assert.Equal(t, nil, err)
+
+	m, err := cfg.ServerMetrics()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "team_shop_http", m.Namespace)
+	assert.Equal(t, "shop", m.ConstLabels["service"])
+	assert.Equal(t, phsserver.BucketConfig{0.1, 0.5, 1}, m.ReqDurationHistConf)
+	assert.Equal(t, phsserver.PercentileConfig{0.9: 0.01}, m.ReqDurationPercentileConf)
+	assert.Equal(t, 0, len(m.ReqSizeBuckets), "request size disabled by empty layout")
+	assert.Equal(t, 0, len(m.RespSizeBuckets), "response size disabled")
+	assert.Equal(t, []phsserver.SLO{{
+		Handler:          "expensive",
+		Target:           0.99,
+		LatencyThreshold: 300 * time.Millisecond,
+		ErrorCodes:       []string{"5xx", "429"},
+	}}, m.SLOs)
+	assert.Equal(t, []time.Duration{5 * time.Minute, time.Hour}, m.SLOWindows)
+
+	c, err := cfg.ClientMetrics()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, phsserver.NewDefaultClientMetrics().ReqDurationHistConf, c.ReqDurationHistConf)
+	assert.Equal(t, 2, len(c.ReqDurationPercentileConf))
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tdata := []struct {
+		name    string
+		content string
+	}{
+		{"phs.yaml", "server:\n  request_duration_buckets: \"1;2;;3\"\n"},
+		{"phs.yaml", "server:\n  unknown: 1\n"},
+		{"phs.yaml", "client:\n  disable: [request_size]\n"},
+		{"phs.json", `{"server": {"request_duration_percentiles": "50:x"}}`},
+		{"phs.yaml", "server:\n  slos: [{handler: x, target: 99}]\n"},
+		{"phs.yaml", "server:\n  slos: [{handler: x, target: 0.9, error_codes: [5x]}]\n"},
+		{"phs.yaml", "server:\n  slos: [{handler: x, target: 0.9, latency_threshold: 4KiB}]\n"},
+		{"phs.yaml", "server:\n  slo_windows: \"5m;1MB\"\n"},
+	}
+	for _, tst := range tdata {
+		path := writeConfig(t, tst.name, tst.content)
+		_, err := phsserver.LoadConfig(path)
+		assert.NotEqual(t, nil, err, tst.content)
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
+
+func TestTextRoundTrip(t *testing.T) {
+	b, err := phsserver.NewBucketConfig("exp(1ms,2,3);1.5s;4KiB")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "0.001;0.002;0.004;1.5;4096", b.String())
+
+	var b2 phsserver.BucketConfig
+	err = b2.UnmarshalText([]byte(b.String()))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, *b, b2)
+
+	p, err := phsserver.NewPercentileConfig("99.9;50;90:1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "50:5;90:1;99.9:0.1", p.String())
+
+	var p2 phsserver.PercentileConfig
+	err = p2.UnmarshalText([]byte(p.String()))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, *p, p2)
+
+	fs := flag.NewFlagSet("phs", flag.ContinueOnError)
+	var fb phsserver.BucketConfig
+	var fp phsserver.PercentileConfig
+	fs.Var(&fb, "buckets", "")
+	fs.Var(&fp, "percentiles", "")
+	err = fs.Parse([]string{"-buckets", "0.1;1", "-percentiles", "50"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, phsserver.BucketConfig{0.1, 1}, fb)
+	assert.Equal(t, phsserver.PercentileConfig{0.5: 0.05}, fp)
+	assert.NotEqual(t, nil, fs.Parse([]string{"-buckets", "1;1"}), "invalid flag value")
+
+	data, err := json.Marshal(struct {
+		B phsserver.BucketConfig
+		P phsserver.PercentileConfig
+	}{fb, fp})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"B":"0.1;1","P":"50:5"}`, string(data))
+}
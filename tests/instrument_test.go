@@ -1,16 +1,20 @@
 package _test
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 	"math"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"sort"
 	"git.bofh.at/mla/phs/pkg/phsserver"
+	"github.com/gorilla/mux"
 	io_prometheus_client "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 )
@@ -28,10 +32,24 @@ func cmpBc(b1 []float64, b2 []float64) (bool, error) {
 }
 
 type bucketResult struct {
-	e error
+	e *phsserver.ParseError
 	r []float64
 }
 
+// parseErrorEqual asserts that err is the expected *ParseError, or nil if
+// none is expected. It returns true if err is nil.
+func parseErrorEqual(t *testing.T, exp *phsserver.ParseError, err error, msg string) bool {
+	if exp == nil {
+		assert.Equal(t, nil, err, msg)
+		return err == nil
+	}
+	var pe *phsserver.ParseError
+	if assert.True(t, errors.As(err, &pe), msg) {
+		assert.Equal(t, exp, pe, msg)
+	}
+	return false
+}
+
 func TestBucketParser(t *testing.T) {
 	tdata := []struct {
 		name  string
@@ -58,7 +76,7 @@ func TestBucketParser(t *testing.T) {
 			"multiple integers, trailing colon",
 			"1;2;3;4;",
 			bucketResult{
-				fmt.Errorf("Cannot parse \"\" into float."),
+				&phsserver.ParseError{Pos: 8, Token: "", Reason: "empty entry"},
 				[]float64{1.0, 2.0, 3.0, 4.0},
 			},
 		},
@@ -66,7 +84,7 @@ func TestBucketParser(t *testing.T) {
 			"multiple integers, embedded double colon",
 			"1;2;;3;4",
 			bucketResult{
-				fmt.Errorf("Cannot parse \"\" into float."),
+				&phsserver.ParseError{Pos: 4, Token: "", Reason: "empty entry"},
 				nil,
 			},
 		},
@@ -74,7 +92,7 @@ func TestBucketParser(t *testing.T) {
 			"multiple integers, leading colon",
 			";1;2;3;4",
 			bucketResult{
-				fmt.Errorf("Cannot parse \"\" into float."),
+				&phsserver.ParseError{Pos: 0, Token: "", Reason: "empty entry"},
 				nil,
 			},
 		},
@@ -82,7 +100,7 @@ func TestBucketParser(t *testing.T) {
 			"multiple integers, out of order",
 			"1;2;4;3",
 			bucketResult{
-				fmt.Errorf("Buckets out of order, idx(3) < idx-1"),
+				&phsserver.ParseError{Pos: 6, Token: "3", Reason: "bound 3 not greater than previous bound 4"},
 				[]float64{1.0, 2.0, 3.0, 4.0},
 			},
 		},
@@ -94,11 +112,140 @@ func TestBucketParser(t *testing.T) {
 				[]float64{1.2, 1024.2, 41234.5},
 			},
 		},
+		{
+			"exponential generator",
+			"exp(0.001,2,4)",
+			bucketResult{
+				nil,
+				[]float64{0.001, 0.002, 0.004, 0.008},
+			},
+		},
+		{
+			"linear generator and value",
+			"lin(1,0.5,3);10",
+			bucketResult{
+				nil,
+				[]float64{1, 1.5, 2, 10},
+			},
+		},
+		{
+			"decade generator",
+			"log(0.001,0.01,2)",
+			bucketResult{
+				nil,
+				[]float64{0.001, 0.00316228, 0.01},
+			},
+		},
+		{
+			"slo targets",
+			"exp(0.1,2,3);slo(0.3,0.4)",
+			bucketResult{
+				nil,
+				[]float64{0.1, 0.2, 0.3, 0.4},
+			},
+		},
+		{
+			"unknown generator",
+			"sqrt(2)",
+			bucketResult{
+				&phsserver.ParseError{Pos: 0, Token: "sqrt(2)", Reason: "unknown bucket generator \"sqrt\""},
+				nil,
+			},
+		},
+		{
+			"generator with missing argument",
+			"exp(1,2)",
+			bucketResult{
+				&phsserver.ParseError{Pos: 0, Token: "exp(1,2)", Reason: "exp needs 3 arguments, got 2"},
+				nil,
+			},
+		},
+		{
+			"generator count too large",
+			"lin(0,1,1000000000)",
+			bucketResult{
+				&phsserver.ParseError{Pos: 0, Token: "lin(0,1,1000000000)",
+					Reason: "linear buckets count 1000000000 exceeds the limit of 1000"},
+				nil,
+			},
+		},
+		{
+			"decade generator too large",
+			"log(1e-300,1e300,1000)",
+			bucketResult{
+				&phsserver.ParseError{Pos: 0, Token: "log(1e-300,1e300,1000)",
+					Reason: "decade buckets exceed the limit of 1000"},
+				nil,
+			},
+		},
+		{
+			"equal bounds",
+			"1;2;2",
+			bucketResult{
+				&phsserver.ParseError{Pos: 4, Token: "2", Reason: "bound 2 not greater than previous bound 2"},
+				nil,
+			},
+		},
+		{
+			"NaN bound",
+			"1;NaN",
+			bucketResult{
+				&phsserver.ParseError{Pos: 2, Token: "NaN", Reason: "bound is NaN"},
+				nil,
+			},
+		},
+		{
+			"infinite bound",
+			"1;+Inf",
+			bucketResult{
+				&phsserver.ParseError{Pos: 2, Token: "+Inf", Reason: "bound is infinite"},
+				nil,
+			},
+		},
+		{
+			"negative bound",
+			"-1;1",
+			bucketResult{
+				&phsserver.ParseError{Pos: 0, Token: "-1", Reason: "bound is negative"},
+				nil,
+			},
+		},
+		{
+			"whitespace and units",
+			" 250ms ; 1s;1.5 m ",
+			bucketResult{
+				nil,
+				[]float64{0.25, 1, 90},
+			},
+		},
+		{
+			"size units",
+			"512B;4KiB;1MB",
+			bucketResult{
+				nil,
+				[]float64{512, 4096, 1e6},
+			},
+		},
+		{
+			"unknown unit",
+			"1;2parsecs",
+			bucketResult{
+				&phsserver.ParseError{Pos: 2, Token: "2parsecs", Reason: "cannot parse \"2parsecs\" into float"},
+				nil,
+			},
+		},
+		{
+			"generator with units",
+			"exp(1ms, 2, 3)",
+			bucketResult{
+				nil,
+				[]float64{0.001, 0.002, 0.004},
+			},
+		},
 	}
 	for _, tst := range tdata {
 		bc, err := phsserver.NewBucketConfig(tst.input)
-		assert.Equal(t, tst.r.e, err, fmt.Sprintf("%s: NewBucketConfig returns Error ", tst.name))
-		if err != nil {
+		if !parseErrorEqual(t, tst.r.e, err, fmt.Sprintf("%s: NewBucketConfig returns Error ", tst.name)) {
 			continue
 		}
 		asfloat := []float64(*bc)
@@ -107,7 +254,7 @@ func TestBucketParser(t *testing.T) {
 }
 
 type percentileResult struct {
-	e error
+	e *phsserver.ParseError
 	r map[float64]float64
 }
 
@@ -192,7 +339,7 @@ func TestPercentileParser(t *testing.T) {
 			"multiple values, embedded semicolon",
 			"20;;50",
 			percentileResult{
-				fmt.Errorf("Cannot parse percentile \"\" of \"\" into float"),
+				&phsserver.ParseError{Pos: 3, Token: "", Reason: "empty entry"},
 				nil,
 			},
 		},
@@ -200,16 +347,50 @@ func TestPercentileParser(t *testing.T) {
 			"multiple values, leading colon",
 			";30;40",
 			percentileResult{
-				fmt.Errorf("Cannot parse percentile \"\" of \"\" into float"),
+				&phsserver.ParseError{Pos: 0, Token: "", Reason: "empty entry"},
+				nil,
+			},
+		},
+		{
+			"more than one colon",
+			"50;90:1:2",
+			percentileResult{
+				&phsserver.ParseError{Pos: 3, Token: "90:1:2", Reason: "more than one colon"},
+				nil,
+			},
+		},
+		{
+			"percentile above 100",
+			"50;101",
+			percentileResult{
+				&phsserver.ParseError{Pos: 3, Token: "101", Reason: "percentile 101 out of range [0, 100]"},
 				nil,
 			},
 		},
+		{
+			"negative error",
+			"50:-1",
+			percentileResult{
+				&phsserver.ParseError{Pos: 0, Token: "50:-1", Reason: "error -1 out of range [0, 100]"},
+				nil,
+			},
+		},
+		{
+			"whitespace",
+			" 50 ; 99 : 0.2 ",
+			percentileResult{
+				nil,
+				map[float64]float64{
+					0.5:0.05,
+					0.99:0.002,
+				},
+			},
+		},
 	}
 	for _, tst := range tdata {
 		bc, err := phsserver.NewPercentileConfig(tst.input)
-		assert.Equal(t, tst.r.e, err,
-			fmt.Sprintf("%s: NewPercentileConfig returns Error ", tst.name))
-		if err != nil {
+		if !parseErrorEqual(t, tst.r.e, err,
+			fmt.Sprintf("%s: NewPercentileConfig returns Error ", tst.name)) {
 			continue
 		}
 		asmap := map[float64]float64(*bc)
@@ -269,3 +450,374 @@ func TestMetrics(t *testing.T) {
 	c.Write(xx)
 	assert.Equal(t, 1.0, *xx.Counter.Value, "counter value")
 }
+
+func TestRegisterWith(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	m1 := phsserver.NewDefaultServerMetrics()
+	err := phsserver.ServerMetricsRegisterWith(reg, m1)
+	assert.Equal(t, nil, err, "first registration")
+
+	m2 := phsserver.NewDefaultServerMetrics()
+	err = phsserver.ServerMetricsRegisterWith(reg, m2)
+	assert.NotEqual(t, nil, err, "duplicate registration")
+
+	err = phsserver.ServerMetricsRegisterWith(prometheus.NewRegistry(), m2)
+	assert.Equal(t, nil, err, "registration with a second registry")
+
+	c := phsserver.NewDefaultClientMetrics()
+	err = phsserver.ClientMetricsRegisterWith(reg, c)
+	assert.Equal(t, nil, err, "client metrics beside server metrics")
+}
+
+func TestNamespace(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	m1 := phsserver.NewDefaultServerMetrics()
+	m1.Namespace = "team_shop_http"
+	m1.ConstLabels = prometheus.Labels{"service": "shop"}
+	err := phsserver.ServerMetricsRegisterWith(reg, m1)
+	assert.Equal(t, nil, err, "first namespace")
+
+	m2 := phsserver.NewDefaultServerMetrics()
+	m2.Namespace = "team_cart_http"
+	err = phsserver.ServerMetricsRegisterWith(reg, m2)
+	assert.Equal(t, nil, err, "second namespace")
+
+	m1.ReqInflight.With(prometheus.Labels{"handler": "cart", "method": "get"}).Inc()
+	mfs, err := reg.Gather()
+	assert.Equal(t, nil, err)
+	found := false
+	for _, mf := range mfs {
+		if mf.GetName() != "team_shop_http_server_requests_inflight" {
+			continue
+		}
+		found = true
+		l := mf.GetMetric()[0].GetLabel()[2]
+		assert.Equal(t, "service", l.GetName())
+		assert.Equal(t, "shop", l.GetValue())
+	}
+	assert.True(t, found, "inflight gauge with namespace")
+}
+
+func TestLabelExtractor(t *testing.T) {
+	m := phsserver.NewDefaultServerMetrics()
+	m.LabelExtractors = []*phsserver.LabelExtractor{
+		phsserver.NewHeaderLabelExtractor("tenant", "X-Tenant", 2),
+	}
+	err := phsserver.ServerMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	handler := phsserver.WrapHandler(http.HandlerFunc(_p1Handler), "p1", m)
+	for _, tenant := range []string{"a", "b", "a", "c", "d"} {
+		req, err := http.NewRequest("GET", "/p1", nil)
+		assert.Equal(t, nil, err)
+		req.Header.Set("X-Tenant", tenant)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for tenant, count := range map[string]float64{"a": 2, "b": 1, "other": 2} {
+		l := prometheus.Labels{
+			"handler": "p1",
+			"method":  "get",
+			"code":    "200",
+			"tenant":  tenant,
+		}
+		assert.Equal(t, count, testutil.ToFloat64(m.ReqCounter.With(l)),
+			fmt.Sprintf("requests of tenant %s", tenant))
+	}
+}
+
+func TestMuxMiddleware(t *testing.T) {
+	m := phsserver.NewDefaultServerMetrics()
+	err := phsserver.ServerMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", _p1Handler)
+	r.HandleFunc("/p1", _p1Handler).Name("p1")
+	r.Use(phsserver.MuxMiddleware(m))
+
+	for _, path := range []string{"/users/1", "/users/2", "/p1"} {
+		req, err := http.NewRequest("GET", path, nil)
+		assert.Equal(t, nil, err)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code, path)
+	}
+
+	for handler, count := range map[string]float64{"/users/{id}": 2, "p1": 1} {
+		l := prometheus.Labels{
+			"handler": handler,
+			"method":  "get",
+			"code":    "200",
+		}
+		assert.Equal(t, count, testutil.ToFloat64(m.ReqCounter.With(l)),
+			fmt.Sprintf("requests of handler %s", handler))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tdata := []struct {
+		name  string
+		m     *phsserver.ServerMetrics
+		valid bool
+	}{
+		{"defaults", phsserver.NewDefaultServerMetrics(), true},
+		{"empty", &phsserver.ServerMetrics{}, true},
+		{
+			"duration buckets out of order",
+			&phsserver.ServerMetrics{ReqDurationHistConf: []float64{1, 2, 2}},
+			false,
+		},
+		{
+			"percentile out of range",
+			&phsserver.ServerMetrics{ReqDurationPercentileConf: map[float64]float64{99: 0.01}},
+			false,
+		},
+		{
+			"NaN percentile",
+			&phsserver.ServerMetrics{ReqDurationPercentileConf: map[float64]float64{math.NaN(): 0.01}},
+			false,
+		},
+		{
+			"NaN percentile error",
+			&phsserver.ServerMetrics{ReqDurationPercentileConf: map[float64]float64{0.5: math.NaN()}},
+			false,
+		},
+		{
+			"invalid namespace",
+			&phsserver.ServerMetrics{Namespace: "my-team"},
+			false,
+		},
+		{
+			"native histogram factor",
+			&phsserver.ServerMetrics{NativeHistogramBucketFactor: 0.5},
+			false,
+		},
+		{
+			"duplicate slo window",
+			&phsserver.ServerMetrics{SLOWindows: []time.Duration{
+				5 * time.Minute, 90 * time.Second, 5 * time.Minute}},
+			false,
+		},
+		{
+			"slo window below resolution",
+			&phsserver.ServerMetrics{SLOWindows: []time.Duration{
+				500 * time.Millisecond, time.Minute}},
+			false,
+		},
+		{
+			"reserved label",
+			&phsserver.ServerMetrics{LabelExtractors: []*phsserver.LabelExtractor{
+				phsserver.NewHeaderLabelExtractor("code", "X-Code", 10),
+			}},
+			false,
+		},
+	}
+	for _, tst := range tdata {
+		err := tst.m.Validate()
+		assert.Equal(t, tst.valid, err == nil, fmt.Sprintf("%s: %v", tst.name, err))
+	}
+}
+
+func TestPercentilesWithoutSizes(t *testing.T) {
+	rqDurPercentiles, err := phsserver.NewPercentileConfig("50;90;99")
+	assert.Equal(t, nil, err)
+	m := &phsserver.ServerMetrics{
+		ReqDurationPercentileConf: *rqDurPercentiles,
+	}
+	err = phsserver.ServerMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	handler := phsserver.WrapHandler(http.HandlerFunc(_p1Handler), "p1", m)
+	req, err := http.NewRequest("GET", "/p1", nil)
+	assert.Equal(t, nil, err)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, 1, testutil.CollectAndCount(m.ReqDurationPercentiles), "summaries")
+}
+
+func TestAdmission(t *testing.T) {
+	m := phsserver.NewDefaultServerMetrics()
+	m.Admission = &phsserver.AdmissionPolicy{
+		MaxInflight:  1,
+		MaxQueue:     1,
+		QueueTimeout: time.Minute,
+		RetryAfter:   1500 * time.Millisecond,
+		Priority:     phsserver.PriorityFromHeader("X-Priority"),
+	}
+	err := phsserver.ServerMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	started := make(chan struct{}, 4)
+	block := make(chan struct{})
+	h := phsserver.WrapHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-block
+		}), "busy", m)
+	serve := func(priority string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Priority", priority)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	queued := func() float64 {
+		return testutil.ToFloat64(m.ReqQueued.With(prometheus.Labels{"handler": "busy"}))
+	}
+
+	go serve("normal")
+	<-started
+
+	low := make(chan *httptest.ResponseRecorder)
+	go func() { low <- serve("low") }()
+	for queued() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	w := serve("low")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "queue full")
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+
+	high := make(chan *httptest.ResponseRecorder)
+	go func() { high <- serve("high") }()
+	w = <-low
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "evicted")
+
+	go serve("critical")
+	<-started
+	close(block)
+	w = <-high
+	assert.Equal(t, http.StatusOK, w.Code, "admitted")
+
+	shed := func(priority, reason string) float64 {
+		return testutil.ToFloat64(m.ReqShed.With(prometheus.Labels{
+			"handler": "busy", "priority": priority, "reason": reason}))
+	}
+	assert.Equal(t, 1.0, shed("low", "queue_full"))
+	assert.Equal(t, 1.0, shed("low", "evicted"))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.ReqCounter.With(prometheus.Labels{
+		"code": "503", "method": "get", "handler": "busy"})), "shed requests counted")
+}
+
+func TestAdmissionInflight(t *testing.T) {
+	m := phsserver.NewDefaultServerMetrics()
+	m.InflightAggregate = true
+	m.Admission = &phsserver.AdmissionPolicy{
+		MaxInflight:  2,
+		MaxQueue:     2,
+		QueueTimeout: time.Minute,
+	}
+	err := phsserver.ServerMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	block := make(chan struct{})
+	h := phsserver.WrapHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-block
+		}), "busy", m)
+	inflight := func() float64 {
+		return testutil.ToFloat64(m.ReqInflight.With(prometheus.Labels{
+			"handler": "busy", "method": "get"}))
+	}
+	shed := func() float64 {
+		return testutil.ToFloat64(m.ReqShed.With(prometheus.Labels{
+			"handler": "busy", "priority": "normal", "reason": "queue_full"}))
+	}
+
+	done := make(chan struct{})
+	for i := 0; i < 6; i++ {
+		go func() {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			done <- struct{}{}
+		}()
+	}
+	for shed() < 2 {
+		assert.True(t, inflight() <= 2, "in flight within MaxInflight")
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.ReqQueued.With(prometheus.Labels{
+		"handler": "busy"})))
+	assert.Equal(t, 2.0, inflight(), "admitted requests only")
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.ReqInflightAggregate))
+
+	close(block)
+	for i := 0; i < 6; i++ {
+		<-done
+	}
+	assert.Equal(t, 0.0, inflight(), "done")
+}
+
+func TestInflightPerHandler(t *testing.T) {
+	m := phsserver.NewDefaultServerMetrics()
+	m.InflightAggregate = true
+	err := phsserver.ServerMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	var inflight, aggregate float64
+	h := phsserver.WrapHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			inflight = testutil.ToFloat64(m.ReqInflight.With(prometheus.Labels{
+				"handler": "expensive", "method": "post"}))
+			aggregate = testutil.ToFloat64(m.ReqInflightAggregate)
+		}), "expensive", m)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+
+	assert.Equal(t, 1.0, inflight, "in flight per handler")
+	assert.Equal(t, 1.0, aggregate, "in flight over all handlers")
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.ReqInflight.With(prometheus.Labels{
+		"handler": "expensive", "method": "post"})), "done")
+}
+
+func TestSLO(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := phsserver.NewDefaultServerMetrics()
+	m.SLOs = []phsserver.SLO{{
+		Handler:          "api",
+		Target:           0.9,
+		LatencyThreshold: time.Second,
+	}}
+	m.SLOWindows = []time.Duration{5 * time.Minute, time.Hour}
+	err := phsserver.ServerMetricsRegisterWith(reg, m)
+	assert.Equal(t, nil, err)
+
+	h := phsserver.WrapHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/fail" {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}), "api", m)
+	for i := 0; i < 8; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fail", nil))
+	}
+
+	values := map[string]float64{}
+	mfs, err := reg.Gather()
+	assert.Equal(t, nil, err)
+	for _, mf := range mfs {
+		for _, metric := range mf.GetMetric() {
+			name := mf.GetName()
+			for _, l := range metric.GetLabel() {
+				if l.GetName() == "window" {
+					name += "/" + l.GetValue()
+				}
+			}
+			switch {
+			case metric.GetCounter() != nil:
+				values[name] = metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				values[name] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+	assert.Equal(t, 8.0, values["http_server_slo_good_events_total"])
+	assert.Equal(t, 10.0, values["http_server_slo_events_total"])
+	assert.Equal(t, 0.9, values["http_server_slo_objective"])
+	assert.InDelta(t, 2.0, values["http_server_slo_burn_rate/5m"], 1e-9)
+	assert.InDelta(t, 2.0, values["http_server_slo_burn_rate/1h"], 1e-9)
+}
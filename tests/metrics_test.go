@@ -0,0 +1,96 @@
+package _test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.bofh.at/mla/phs/pkg/phsserver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := phsserver.NewDefaultServerMetrics()
+	err := phsserver.ServerMetricsRegisterWith(reg, m)
+	assert.Equal(t, nil, err)
+
+	h := phsserver.NewMetricsHandler(phsserver.MetricsHandlerOpts{
+		Gatherer:   reg,
+		Registerer: reg,
+	})
+
+	tdata := []struct {
+		accept      string
+		encoding    string
+		contentType string
+	}{
+		{"", "", "text/plain"},
+		{"application/openmetrics-text; version=0.0.1", "", "application/openmetrics-text"},
+		{"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited", "", "application/vnd.google.protobuf"},
+		{"", "gzip", "text/plain"},
+	}
+	for _, tst := range tdata {
+		req, err := http.NewRequest("GET", "/metrics", nil)
+		assert.Equal(t, nil, err)
+		req.Header.Set("Accept", tst.accept)
+		req.Header.Set("Accept-Encoding", tst.encoding)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code, tst.accept)
+		assert.True(t, strings.HasPrefix(rr.Header().Get("Content-Type"), tst.contentType),
+			"content type %q for %q", rr.Header().Get("Content-Type"), tst.accept)
+		assert.Equal(t, tst.encoding, rr.Header().Get("Content-Encoding"), tst.accept)
+	}
+}
+
+func TestMetricsHandlerGathererOnly(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	h := phsserver.NewMetricsHandler(phsserver.MetricsHandlerOpts{Gatherer: reg})
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		if i == 1 {
+			assert.True(t, strings.Contains(rr.Body.String(),
+				`promhttp_metric_handler_requests_total{code="200"} 1`),
+				"scrape metrics in the served registry")
+		}
+	}
+}
+
+func TestMetricsServer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	s := phsserver.NewMetricsServer("127.0.0.1:0", phsserver.MetricsHandlerOpts{
+		Gatherer:   reg,
+		Registerer: reg,
+	})
+	err := s.Start()
+	assert.Equal(t, nil, err)
+
+	busy := phsserver.NewMetricsServer(s.Addr(), phsserver.MetricsHandlerOpts{
+		Gatherer:   reg,
+		Registerer: reg,
+	})
+	assert.NotEqual(t, nil, busy.Start(), "listen on a port in use")
+
+	resp, err := http.Get("http://" + s.Addr() + "/metrics")
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get("http://" + s.Addr() + "/expensive")
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	err = s.Shutdown(context.Background())
+	assert.Equal(t, nil, err)
+	_, err = http.Get("http://" + s.Addr() + "/metrics")
+	assert.NotEqual(t, nil, err, "scrape after shutdown")
+}
@@ -0,0 +1,412 @@
+package _test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.bofh.at/mla/phs/pkg/phsclient"
+	"git.bofh.at/mla/phs/pkg/phsserver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type widget struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestServiceClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/widgets", func(w http.ResponseWriter, r *http.Request) {
+		var in widget
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		in.Count++
+		json.NewEncoder(w).Encode(in)
+	})
+	mux.HandleFunc("/api/missing", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "no such widget"}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	m := phsserver.NewDefaultClientMetrics()
+	err := phsserver.ClientMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+	c, err := phsclient.NewInstrumentedClient(srv.URL+"/api", "widgets", m)
+	assert.Equal(t, nil, err)
+
+	ctx := context.Background()
+	req, err := c.NewRequest(ctx, http.MethodPost, "widgets", widget{Name: "gear", Count: 1})
+	assert.Equal(t, nil, err)
+	var out widget
+	_, err = c.Do(ctx, "widgets:create", req, &out)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, widget{Name: "gear", Count: 2}, out)
+
+	req, err = c.NewRequest(ctx, http.MethodGet, "missing", nil)
+	assert.Equal(t, nil, err)
+	resp, err := c.Do(ctx, "", req, nil)
+	var e *phsclient.ErrorResponse
+	assert.True(t, errors.As(err, &e), "error response")
+	assert.Equal(t, "no such widget", e.Message)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.ReqCounter.With(prometheus.Labels{
+		"code": "200", "method": "post", "endpoint": "widgets:create", "action": "unknown",
+	})), "labeled with endpoint id")
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.ReqCounter.With(prometheus.Labels{
+		"code": "404", "method": "get", "endpoint": "widgets", "action": "unknown",
+	})), "labeled with service")
+}
+
+func TestRetry(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&calls, 1)
+			switch {
+			case r.Method == http.MethodPost:
+				w.WriteHeader(http.StatusBadGateway)
+			case n < 3:
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusServiceUnavailable)
+			default:
+				io.WriteString(w, "OK")
+			}
+		}))
+	defer srv.Close()
+
+	m := phsserver.NewDefaultClientMetrics()
+	err := phsserver.ClientMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	p := phsclient.NewDefaultRetryPolicy()
+	p.InitialBackoff = time.Millisecond
+	c := &http.Client{
+		Transport: phsserver.WrapTransport(
+			phsclient.NewRetryTransport(nil, "flaky", p, m), "flaky", m),
+	}
+
+	resp, err := c.Get(srv.URL)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.Retries.With(prometheus.Labels{
+		"method": "get", "endpoint": "flaky", "reason": "503",
+	})), "retries")
+	assert.Equal(t, 1, testutil.CollectAndCount(m.ReqCounter), "final outcome only")
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.ReqCounter.With(prometheus.Labels{
+		"code": "200", "method": "get", "endpoint": "flaky", "action": "unknown",
+	})), "final outcome")
+
+	// 502 is not retried for non-idempotent methods.
+	resp, err = c.Post(srv.URL, "text/plain", strings.NewReader("body"))
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+
+	// The wait must fit into the deadline of the context.
+	atomic.StoreInt32(&calls, 0)
+	p.InitialBackoff = time.Hour
+	c.Transport = phsclient.NewRetryTransport(nil, "flaky", p, m)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	assert.Equal(t, nil, err)
+	resp, err = c.Do(req)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var healthy int32
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			if atomic.LoadInt32(&healthy) == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+	defer srv.Close()
+
+	m := phsserver.NewDefaultClientMetrics()
+	err := phsserver.ClientMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	p := phsclient.NewDefaultBreakerPolicy()
+	p.ConsecutiveFailures = 3
+	p.CoolDown = 50 * time.Millisecond
+	c := &http.Client{
+		Transport: phsclient.NewBreakerTransport(nil, "cheap", p, m),
+	}
+	state := func(s string) float64 {
+		return testutil.ToFloat64(m.CircuitState.With(prometheus.Labels{
+			"endpoint": "cheap", "state": s}))
+	}
+	get := func() error {
+		resp, err := c.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, nil, get())
+	}
+	assert.Equal(t, 1.0, state("open"), "open after consecutive failures")
+	assert.Equal(t, 0.0, state("closed"))
+	err = get()
+	assert.True(t, errors.Is(err, phsclient.ErrCircuitOpen), "fail fast")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	time.Sleep(2 * p.CoolDown)
+	atomic.StoreInt32(&healthy, 1)
+	assert.Equal(t, nil, get())
+	assert.Equal(t, 1.0, state("closed"), "closed after successful probe")
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.CircuitTransitions.With(prometheus.Labels{
+		"endpoint": "cheap", "from": "half_open", "to": "closed"})))
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-block
+		}))
+	defer srv.Close()
+	defer close(block)
+
+	m := phsserver.NewDefaultClientMetrics()
+	err := phsserver.ClientMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	p := phsclient.NewDefaultLimitPolicy()
+	p.Limit = 1
+	p.MaxQueue = 1
+	p.QueueTimeout = 50 * time.Millisecond
+	c := &http.Client{
+		Transport: phsclient.NewLimitTransport(nil, "slow", p, m),
+	}
+	l := prometheus.Labels{"endpoint": "slow"}
+	get := func() error {
+		resp, err := c.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	go get()
+	for testutil.ToFloat64(m.ReqInflight.With(l)) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	queued := make(chan error)
+	go func() { queued <- get() }()
+	for testutil.ToFloat64(m.ReqQueued.With(l)) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	err = get()
+	assert.True(t, errors.Is(err, phsclient.ErrLimitExceeded), "queue full")
+
+	err = <-queued
+	assert.True(t, errors.Is(err, phsclient.ErrLimitExceeded), "queue timeout")
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.ReqQueued.With(l)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.ReqRejected.With(prometheus.Labels{
+		"endpoint": "slow", "reason": "queue_full"})))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.ReqRejected.With(prometheus.Labels{
+		"endpoint": "slow", "reason": "timeout"})))
+}
+
+func TestRetryLimits(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			if r.Method == http.MethodGet {
+				w.Header().Set("Retry-After", "86400")
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+	defer srv.Close()
+
+	m := phsserver.NewDefaultClientMetrics()
+	err := phsserver.ClientMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	p := phsclient.NewDefaultRetryPolicy()
+	p.InitialBackoff = time.Millisecond
+	p.Jitter = 5
+	c := &http.Client{
+		Transport: phsclient.NewRetryTransport(nil, "busy", p, m),
+	}
+
+	resp, err := c.Get(srv.URL)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "Retry-After above the limit")
+
+	req, err := http.NewRequest("BREW", srv.URL, nil)
+	assert.Equal(t, nil, err)
+	resp, err = c.Do(req)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.Retries.With(prometheus.Labels{
+		"method": "unknown", "endpoint": "busy", "reason": "503",
+	})), "sanitized method label")
+}
+
+func TestCircuitBreakerIgnoresLocalRejections(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-block
+		}))
+	defer srv.Close()
+	defer close(block)
+
+	m := phsserver.NewDefaultClientMetrics()
+	err := phsserver.ClientMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	lp := phsclient.NewDefaultLimitPolicy()
+	lp.Limit = 1
+	lp.MaxQueue = 0
+	bp := phsclient.NewDefaultBreakerPolicy()
+	bp.ConsecutiveFailures = 2
+	c := &http.Client{
+		Transport: phsclient.NewBreakerTransport(
+			phsclient.NewLimitTransport(nil, "slow", lp, m), "slow", bp, m),
+	}
+	l := prometheus.Labels{"endpoint": "slow"}
+
+	go c.Get(srv.URL)
+	for testutil.ToFloat64(m.ReqInflight.With(l)) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		_, err = c.Get(srv.URL)
+		assert.True(t, errors.Is(err, phsclient.ErrLimitExceeded), "queue full")
+	}
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.CircuitState.With(prometheus.Labels{
+		"endpoint": "slow", "state": "closed"})), "circuit stays closed on a full queue")
+
+	c.Transport = phsclient.NewBreakerTransport(nil, "canceled", bp, m)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	assert.Equal(t, nil, err)
+	for i := 0; i < 3; i++ {
+		_, err = c.Do(req)
+		assert.True(t, errors.Is(err, context.Canceled), "canceled by the caller")
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.CircuitState.With(prometheus.Labels{
+		"endpoint": "canceled", "state": "closed"})), "circuit stays closed on cancellation")
+}
+
+func TestClientTransportChain(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-block
+		}))
+	defer srv.Close()
+	defer close(block)
+
+	m := phsserver.NewDefaultClientMetrics()
+	err := phsserver.ClientMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	lp := phsclient.NewDefaultLimitPolicy()
+	lp.Limit = 1
+	lp.MaxQueue = 0
+	bp := phsclient.NewDefaultBreakerPolicy()
+	bp.ConsecutiveFailures = 2
+	rp := phsclient.NewDefaultRetryPolicy()
+	rp.InitialBackoff = time.Millisecond
+	c := &http.Client{
+		Transport: phsserver.WrapTransport(
+			phsclient.NewRetryTransport(
+				phsclient.NewBreakerTransport(
+					phsclient.NewLimitTransport(nil, "chain", lp, m),
+					"chain", bp, m),
+				"chain", rp, m),
+			"chain", m),
+	}
+	l := prometheus.Labels{"endpoint": "chain"}
+
+	go c.Get(srv.URL)
+	for testutil.ToFloat64(m.ReqInflight.With(l)) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		_, err = c.Get(srv.URL)
+		assert.True(t, errors.Is(err, phsclient.ErrLimitExceeded), "queue full")
+	}
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.ReqRejected.With(prometheus.Labels{
+		"endpoint": "chain", "reason": "queue_full"})), "not retried")
+	assert.Equal(t, 0, testutil.CollectAndCount(m.Retries), "no retries")
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.ReqCounter.With(prometheus.Labels{
+		"code": "error", "method": "get", "endpoint": "chain", "action": "unknown",
+	})), "counted once per request")
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.CircuitState.With(prometheus.Labels{
+		"endpoint": "chain", "state": "closed"})), "circuit stays closed")
+	assert.Equal(t, 0, testutil.CollectAndCount(m.CircuitTransitions), "no transitions")
+}
+
+func TestCircuitBreakerCountsTimeouts(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-block:
+			case <-r.Context().Done():
+			}
+		}))
+	defer srv.Close()
+	defer close(block)
+
+	m := phsserver.NewDefaultClientMetrics()
+	err := phsserver.ClientMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	p := phsclient.NewDefaultBreakerPolicy()
+	p.ConsecutiveFailures = 3
+	p.CoolDown = time.Minute
+	c := &http.Client{
+		Transport: phsclient.NewBreakerTransport(nil, "hanging", p, m),
+		Timeout:   20 * time.Millisecond,
+	}
+	for i := 0; i < 3; i++ {
+		_, err = c.Get(srv.URL)
+		assert.NotEqual(t, nil, err, "timeout")
+	}
+
+	_, err = c.Get(srv.URL)
+	assert.True(t, errors.Is(err, phsclient.ErrCircuitOpen), "open after timeouts")
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.CircuitState.With(prometheus.Labels{
+		"endpoint": "hanging", "state": "open"})))
+}
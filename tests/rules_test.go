@@ -0,0 +1,59 @@
+package _test
+
+import (
+	"testing"
+	"time"
+
+	"git.bofh.at/mla/phs/pkg/phsserver"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRules(t *testing.T) {
+	s := phsserver.NewDefaultServerMetrics()
+	s.Namespace = "shop"
+	s.SLOs = []phsserver.SLO{{Handler: "expensive", Target: 0.99}}
+	s.SLOWindows = []time.Duration{5 * time.Minute, time.Hour}
+	c := phsserver.NewDefaultClientMetrics()
+	c.ReqDurationHistConf = nil
+
+	data, err := phsserver.NewRuleFile(s, c).Marshal()
+	assert.Equal(t, nil, err)
+
+	var f phsserver.RuleFile
+	err = yaml.UnmarshalStrict(data, &f)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(f.Groups))
+
+	records := map[string]string{}
+	alerts := 0
+	for _, g := range f.Groups {
+		for _, r := range g.Rules {
+			if r.Record != "" {
+				records[r.Record] = r.Expr
+			} else {
+				alerts++
+				assert.Equal(t, "job_handler:shop_server_slo_events_total:burn_rate1h > 14.4"+
+					" and job_handler:shop_server_slo_events_total:burn_rate5m > 14.4", r.Expr)
+			}
+		}
+	}
+	assert.Equal(t, 1, alerts, "only burn alerts with both windows")
+	assert.Equal(t, "(1 - sum by (job, handler) (rate(shop_server_slo_good_events_total[1h]))"+
+		" / sum by (job, handler) (rate(shop_server_slo_events_total[1h])))"+
+		" / (1 - max by (job, handler) (shop_server_slo_objective))",
+		records["job_handler:shop_server_slo_events_total:burn_rate1h"], "burn rate from counters")
+	_, ok := records["job_handler:shop_server_slo_events_total:burn_rate5m"]
+	assert.True(t, ok, "burn rate of every window")
+	assert.Equal(t, "histogram_quantile(0.99, sum by (job, handler, le) "+
+		"(rate(shop_server_request_duration_bucket[5m])))",
+		records["job_handler:shop_server_request_duration:p99_rate5m"], "server percentile")
+	assert.Equal(t, `sum by (job, handler) (rate(shop_server_requests_total{code=~"5.."}[5m]))`+
+		` / sum by (job, handler) (rate(shop_server_requests_total[5m]))`,
+		records["job_handler:shop_server_requests_total:error_ratio_rate5m"], "server error ratio")
+	assert.Equal(t, `sum by (job, endpoint) (rate(http_client_requests_total{code=~"5..|error"}[5m]))`+
+		` / sum by (job, endpoint) (rate(http_client_requests_total[5m]))`,
+		records["job_endpoint:http_client_requests_total:error_ratio_rate5m"], "client error ratio")
+	_, ok = records["job_endpoint:http_client_requests_duration:p50_rate5m"]
+	assert.False(t, ok, "no percentiles without client histogram")
+}
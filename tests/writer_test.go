@@ -0,0 +1,121 @@
+package _test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.bofh.at/mla/phs/pkg/phsserver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// fullWriter implements all optional interfaces of a http.ResponseWriter.
+type fullWriter struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *fullWriter) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+func (w *fullWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func (w *fullWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(w.ResponseRecorder, r)
+}
+
+func (w *fullWriter) Push(target string, opts *http.PushOptions) error {
+	return nil
+}
+
+func TestResponseWriter(t *testing.T) {
+	fw := &fullWriter{ResponseRecorder: httptest.NewRecorder()}
+	w := phsserver.NewResponseWriter(fw)
+
+	_, ok := w.(http.CloseNotifier)
+	assert.True(t, ok, "CloseNotifier")
+	_, ok = w.(http.Flusher)
+	assert.True(t, ok, "Flusher")
+	_, ok = w.(http.Hijacker)
+	assert.True(t, ok, "Hijacker")
+	_, ok = w.(io.ReaderFrom)
+	assert.True(t, ok, "ReaderFrom")
+	_, ok = w.(http.Pusher)
+	assert.True(t, ok, "Pusher")
+
+	n, err := w.(io.ReaderFrom).ReadFrom(strings.NewReader("Hello"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(5), n)
+	io.WriteString(w, ", World")
+	w.(http.Flusher).Flush()
+	w.(http.Hijacker).Hijack()
+
+	assert.Equal(t, http.StatusOK, w.Status())
+	assert.Equal(t, int64(12), w.Written())
+	assert.True(t, w.TimeToFirstByte() > 0, "time to first byte")
+	assert.True(t, fw.hijacked, "hijacked")
+	assert.Equal(t, "Hello, World", fw.Body.String())
+
+	plain := phsserver.NewResponseWriter(struct{ http.ResponseWriter }{httptest.NewRecorder()})
+	_, ok = plain.(http.Flusher)
+	assert.False(t, ok, "no Flusher on a plain writer")
+	plain.WriteHeader(http.StatusNotFound)
+	assert.Equal(t, http.StatusNotFound, plain.Status())
+	assert.Equal(t, int64(0), plain.Written())
+}
+
+func TestResponseSize(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := phsserver.NewDefaultServerMetrics()
+	err := phsserver.ServerMetricsRegisterWith(reg, m)
+	assert.Equal(t, nil, err)
+
+	handler := phsserver.WrapHandler(http.HandlerFunc(_p1Handler), "p1", m)
+	req, err := http.NewRequest("GET", "/p1", nil)
+	assert.Equal(t, nil, err)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	n, err := testutil.GatherAndCount(reg, "http_server_response_size")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, n, "registered response size histogram")
+}
+
+func TestTimeToFirstByte(t *testing.T) {
+	ttfb, err := phsserver.NewBucketConfig("1ms;10ms;100ms;1s")
+	assert.Equal(t, nil, err)
+	m := phsserver.NewDefaultServerMetrics()
+	m.TimeToWriteHeaderBuckets = *ttfb
+	m.TimeToFirstByteBuckets = *ttfb
+	err = phsserver.ServerMetricsRegisterWith(prometheus.NewRegistry(), m)
+	assert.Equal(t, nil, err)
+
+	stream := phsserver.WrapHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			io.WriteString(w, "chunk")
+		}), "stream", m)
+	empty := phsserver.WrapHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}), "empty", m)
+
+	for _, h := range []http.Handler{stream, empty} {
+		req, err := http.NewRequest("GET", "/", nil)
+		assert.Equal(t, nil, err)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, 2, testutil.CollectAndCount(m.TimeToWriteHeader), "time to write header")
+	assert.Equal(t, 1, testutil.CollectAndCount(m.TimeToFirstByte), "time to first byte")
+}